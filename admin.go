@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	PurgeBatch = 500
+
+	PurgeDone    = "done"
+	PurgeFailed  = "failed"
+	PurgeRunning = "running"
+)
+
+// Admin manages stored keys on behalf of operators.
+type Admin struct {
+	confs     []*IndexConf
+	connPool  *redis.Pool
+	encryptor *Encryptor
+
+	mutex     sync.Mutex
+	purges    map[int]*Purge
+	purgesSeq int
+}
+
+type KeyInfo struct {
+	Codec     string `json:"codec"`
+	Encrypted bool   `json:"encrypted"`
+	Index     string `json:"index"`
+	Key       string `json:"key"`
+	Lines     int    `json:"lines"`
+	Size      int    `json:"size"`
+
+	// Remaining TTL in seconds, or -1 if the key is pinned.
+	TTL   int    `json:"ttl"`
+	Value string `json:"value"`
+}
+
+// Purge tracks the progress of deleting every key of an index.
+type Purge struct {
+	Deleted    int        `json:"deleted"`
+	Error      string     `json:"error,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	ID         int        `json:"id"`
+	Index      string     `json:"index"`
+	StartedAt  time.Time  `json:"started_at"`
+	Status     string     `json:"status"`
+}
+
+func NewAdmin(confs []*IndexConf, connPool *redis.Pool) *Admin {
+	return &Admin{
+		confs:    confs,
+		connPool: connPool,
+		purges:   make(map[int]*Purge),
+	}
+}
+
+// Finds the conf for an index by its key.
+func (a *Admin) findConf(index string) *IndexConf {
+	for _, conf := range a.confs {
+		if conf.key == index {
+			return conf
+		}
+	}
+	return nil
+}
+
+// Deletes a stored key along with its entries in the recent keys index,
+// feed, and search index. The key's lines are read first to find the search
+// tokens and recent tags that it was recorded under.
+func (a *Admin) Delete(conf *IndexConf, value string) (bool, error) {
+	conn := a.connPool.Get()
+	defer conn.Close()
+
+	key := buildKey(conf.key, value)
+	lines, err := a.storedLines(conn, key)
+	if err != nil {
+		// still delete the key, which is what matters most
+		fmt.Fprintf(os.Stderr,
+			"Couldn't read lines of %s to clean up its index entries: %s\n",
+			key, err.Error())
+	}
+
+	conn.Send("MULTI")
+	conn.Send("DEL", key)
+	conn.Send("ZREM", buildRecentKey(conf.key, "", ""), value)
+	conn.Send("ZREM", buildFeedKey(conf.key), value)
+	for _, tagKey := range recentTagKeys(conf, a.encryptor, lines) {
+		conn.Send("ZREM", tagKey, value)
+	}
+
+	// tokens are found line by line because each group written was capped
+	// at SearchMaxTokens separately, and a value that went over a cap is in
+	// the truncated set too
+	if conf.searchMax > 0 {
+		conn.Send("ZREM", buildSearchTruncatedKey(conf.key), value)
+
+		tokens := make(map[string]bool)
+		for _, line := range lines {
+			lineTokens, _ := searchTokens(conf, [][]byte{line})
+			for token := range lineTokens {
+				tokens[token] = true
+			}
+		}
+		for token := range tokens {
+			conn.Send("ZREM", buildSearchKey(conf.key, a.encryptor.IndexToken(token)), value)
+		}
+	}
+
+	res, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return false, err
+	}
+
+	deleted, err := redis.Int(res[0], nil)
+	return deleted > 0, err
+}
+
+// Reads the lines stored in a key, or none if it doesn't exist.
+func (a *Admin) storedLines(conn redis.Conn, key string) ([][]byte, error) {
+	stored, err := redis.Bytes(conn.Do("GET", key))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	decrypted, err := a.encryptor.Decrypt(key, stored)
+	if err != nil {
+		return nil, err
+	}
+
+	blob, err := decodeBlob(decrypted)
+	if err != nil {
+		return nil, err
+	}
+
+	return readLines(blob)
+}
+
+// Describes a stored key without returning its contents.
+func (a *Admin) Inspect(conf *IndexConf, value string) (*KeyInfo, bool, error) {
+	conn := a.connPool.Get()
+	defer conn.Close()
+
+	key := buildKey(conf.key, value)
+	stored, err := redis.Bytes(conn.Do("GET", key))
+	if err == redis.ErrNil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	ttl, err := redis.Int(conn.Do("TTL", key))
+	if err != nil {
+		return nil, false, err
+	}
+
+	decrypted, err := a.encryptor.Decrypt(key, stored)
+	if err != nil {
+		return nil, false, err
+	}
+
+	blob, err := decodeBlob(decrypted)
+	if err != nil {
+		return nil, false, err
+	}
+
+	lines, err := readLines(blob)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &KeyInfo{
+		Codec:     blob.Codec.Tag(),
+		Encrypted: bytes.HasPrefix(stored, encryptedMagic),
+		Index:     conf.key,
+		Key:       key,
+		Lines:     len(lines),
+		Size:      len(stored),
+		TTL:       ttl,
+		Value:     value,
+	}, true, nil
+}
+
+// Keeps a key around longer. With a zero TTL the key never expires, and
+// otherwise its TTL is extended to the given one (but never shortened).
+// Writes to a key that never expires leave it that way (see retentionTTL).
+func (a *Admin) Pin(conf *IndexConf, value string, ttl time.Duration) (bool, error) {
+	conn := a.connPool.Get()
+	defer conn.Close()
+
+	key := buildKey(conf.key, value)
+
+	exists, err := redis.Bool(conn.Do("EXISTS", key))
+	if err != nil || !exists {
+		return false, err
+	}
+
+	if ttl == 0 {
+		if _, err := conn.Do("PERSIST", key); err != nil {
+			return false, err
+		}
+	} else {
+		currentTTL, err := redis.Int(conn.Do("TTL", key))
+		if err != nil {
+			return false, err
+		}
+
+		// a key that already never expires shouldn't be given a TTL
+		if currentTTL != -1 && currentTTL < int(ttl.Seconds()) {
+			if _, err := conn.Do("EXPIRE", key, int(ttl.Seconds())); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	return true, nil
+}
+
+// Starts deleting every key of an index, along with its secondary indexes
+// and stats, in the background.
+func (a *Admin) Purge(conf *IndexConf) *Purge {
+	a.mutex.Lock()
+	a.purgesSeq++
+	purge := &Purge{
+		ID:        a.purgesSeq,
+		Index:     conf.key,
+		StartedAt: time.Now().UTC(),
+		Status:    PurgeRunning,
+	}
+	a.purges[purge.ID] = purge
+	snapshot := *purge
+	a.mutex.Unlock()
+
+	go a.runPurge(conf, purge)
+	return &snapshot
+}
+
+// Gets a copy of a purge's current progress.
+func (a *Admin) FindPurge(id int) (*Purge, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	purge, ok := a.purges[id]
+	if !ok {
+		return nil, false
+	}
+
+	snapshot := *purge
+	return &snapshot, true
+}
+
+func (a *Admin) runPurge(conf *IndexConf, purge *Purge) {
+	err := a.purgeKeys(conf, purge)
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	finishedAt := time.Now().UTC()
+	purge.FinishedAt = &finishedAt
+	purge.Status = PurgeDone
+	if err != nil {
+		purge.Error = err.Error()
+		purge.Status = PurgeFailed
+	}
+
+	printVerbose("purge id=%v index=%v deleted=%v status=%v\n",
+		purge.ID, purge.Index, purge.Deleted, purge.Status)
+}
+
+func (a *Admin) purgeKeys(conf *IndexConf, purge *Purge) error {
+	conn := a.connPool.Get()
+	defer conn.Close()
+
+	patterns := []string{
+		buildKey(conf.key, "*"),
+		buildRecentKey(conf.key, "", ""),
+		buildRecentKey(conf.key, "*", "*"),
+		buildFeedKey(conf.key),
+		buildSampleKey(conf.key, "*"),
+		buildSearchKey(conf.key, "*"),
+		buildStatsKey(conf.key),
+	}
+
+	for _, pattern := range patterns {
+		cursor := 0
+		for {
+			values, err := redis.Values(conn.Do("SCAN", cursor,
+				"MATCH", pattern, "COUNT", PurgeBatch))
+			if err != nil {
+				return err
+			}
+
+			cursor, _ = redis.Int(values[0], nil)
+			keys, _ := redis.Strings(values[1], nil)
+			if len(keys) > 0 {
+				args := make([]interface{}, len(keys))
+				for i, key := range keys {
+					args[i] = key
+				}
+
+				deleted, err := redis.Int(conn.Do("DEL", args...))
+				if err != nil {
+					return err
+				}
+
+				a.mutex.Lock()
+				purge.Deleted += deleted
+				a.mutex.Unlock()
+			}
+
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestAdminInspect(t *testing.T) {
+	setup(t)
+
+	receiver := NewReceiver([]*IndexConf{conf}, connPool)
+	admin := NewAdmin([]*IndexConf{conf}, connPool)
+
+	_, ok, err := admin.Inspect(conf, "req1")
+	if err != nil {
+		t.Error(err)
+	}
+	if ok {
+		t.Errorf("Expected found false, got true\n")
+	}
+
+	_, err = receiver.compress(conf, "req1", [][]byte{
+		[]byte("request_id=req1 n=1"),
+		[]byte("request_id=req1 n=2"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, ok, err := admin.Inspect(conf, "req1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatalf("Expected found true, got false\n")
+	}
+	if info.Lines != 2 {
+		t.Errorf("Expected %v lines, got %v\n", 2, info.Lines)
+	}
+	if info.Codec != "gzip" {
+		t.Errorf("Expected codec %v, got %v\n", "gzip", info.Codec)
+	}
+	if info.TTL <= 0 || info.TTL > 3600 {
+		t.Errorf("Expected TTL of at most %v, got %v\n", 3600, info.TTL)
+	}
+	if info.Size <= 0 {
+		t.Errorf("Expected a size, got %v\n", info.Size)
+	}
+}
+
+func TestAdminPin(t *testing.T) {
+	setup(t)
+
+	receiver := NewReceiver([]*IndexConf{conf}, connPool)
+	admin := NewAdmin([]*IndexConf{conf}, connPool)
+
+	conn := connPool.Get()
+	defer conn.Close()
+
+	key := buildKey(conf.key, "req1")
+
+	ok, err := admin.Pin(conf, "req1", 0)
+	if err != nil {
+		t.Error(err)
+	}
+	if ok {
+		t.Errorf("Expected pinning a missing key to fail\n")
+	}
+
+	_, err = receiver.compress(conf, "req1", [][]byte{[]byte("request_id=req1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err = admin.Pin(conf, "req1", 7*24*time.Hour)
+	if err != nil || !ok {
+		t.Fatalf("Expected pin to succeed, got %v %v\n", ok, err)
+	}
+
+	ttl, _ := redis.Int(conn.Do("TTL", key))
+	if ttl != 7*24*3600 {
+		t.Errorf("Expected TTL %v, got %v\n", 7*24*3600, ttl)
+	}
+
+	ok, err = admin.Pin(conf, "req1", 0)
+	if err != nil || !ok {
+		t.Fatalf("Expected pin to succeed, got %v %v\n", ok, err)
+	}
+
+	// a pinned key stays pinned when it's written to
+	_, err = receiver.compress(conf, "req1", [][]byte{[]byte("request_id=req1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ttl, _ = redis.Int(conn.Do("TTL", key))
+	if ttl != -1 {
+		t.Errorf("Expected TTL %v, got %v\n", -1, ttl)
+	}
+}
+
+func TestAdminDelete(t *testing.T) {
+	setup(t)
+
+	recentConf := &IndexConf{
+		key:        "request_id",
+		recentMax:  10,
+		recentTags: []string{"at"},
+		searchMax:  10,
+		ttl:        1 * time.Hour,
+	}
+	receiver := NewReceiver([]*IndexConf{recentConf}, connPool)
+	admin := NewAdmin([]*IndexConf{recentConf}, connPool)
+
+	receiver.storeGroups(StorageGroup{
+		recentConf: {
+			"req1": [][]byte{[]byte("request_id=req1 at=error msg=timeout")},
+			"req2": [][]byte{[]byte("request_id=req2 at=error")},
+		},
+	})
+
+	ok, err := admin.Delete(recentConf, "req1")
+	if err != nil || !ok {
+		t.Fatalf("Expected delete to succeed, got %v %v\n", ok, err)
+	}
+
+	conn := connPool.Get()
+	defer conn.Close()
+
+	exists, _ := redis.Bool(conn.Do("EXISTS", buildKey("request_id", "req1")))
+	if exists {
+		t.Errorf("Expected key to be deleted\n")
+	}
+
+	recent, _ := redis.Int(conn.Do("ZCARD", buildRecentKey("request_id", "", "")))
+	if recent != 1 {
+		t.Errorf("Expected %v recent keys, got %v\n", 1, recent)
+	}
+
+	// the value is gone from every index that its lines were recorded in,
+	// while other values stay
+	indexKeys := []string{
+		buildRecentKey("request_id", "at", "error"),
+		buildSearchKey("request_id", "at=error"),
+		buildSearchKey("request_id", "timeout"),
+	}
+	for _, key := range indexKeys {
+		members, err := redis.Strings(conn.Do("ZRANGE", key, 0, -1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, member := range members {
+			if member == "req1" {
+				t.Errorf("Expected req1 to be removed from %v\n", key)
+			}
+		}
+	}
+
+	members, _ := redis.Strings(conn.Do("ZRANGE", buildSearchKey("request_id", "at=error"), 0, -1))
+	if len(members) != 1 || members[0] != "req2" {
+		t.Errorf("Expected only req2 left in the search index, got %v\n", members)
+	}
+
+	ok, err = admin.Delete(recentConf, "req1")
+	if err != nil {
+		t.Error(err)
+	}
+	if ok {
+		t.Errorf("Expected deleting a missing key to fail\n")
+	}
+}
+
+func TestAdminPurge(t *testing.T) {
+	setup(t)
+
+	searchConf := &IndexConf{key: "request_id", recentMax: 10, searchMax: 10, ttl: 1 * time.Hour}
+	receiver := NewReceiver([]*IndexConf{searchConf}, connPool)
+	admin = NewAdmin([]*IndexConf{searchConf}, connPool)
+
+	receiver.storeGroups(StorageGroup{
+		searchConf: {
+			"req1": [][]byte{[]byte("request_id=req1 at=info")},
+			"req2": [][]byte{[]byte("request_id=req2 at=error")},
+		},
+	})
+
+	w := httptest.NewRecorder()
+	adminPurges(w, httptest.NewRequest("POST", "/admin/indexes/request_id/purge", nil))
+	if w.Code != 202 {
+		t.Fatalf("Expected code 202, got %v\n", w.Code)
+	}
+
+	var purge *Purge
+	for i := 0; i < 100; i++ {
+		purge, _ = admin.FindPurge(1)
+		if purge.Status != PurgeRunning {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if purge.Status != PurgeDone {
+		t.Fatalf("Expected status %v, got %v\n", PurgeDone, purge.Status)
+	}
+
+	conn := connPool.Get()
+	defer conn.Close()
+
+	keys, _ := redis.Strings(conn.Do("KEYS", "*"))
+	if len(keys) != 0 {
+		t.Errorf("Expected no keys left, got %v\n", keys)
+	}
+	if purge.Deleted < 2 {
+		t.Errorf("Expected at least %v keys deleted, got %v\n", 2, purge.Deleted)
+	}
+
+	w = httptest.NewRecorder()
+	adminPurges(w, httptest.NewRequest("GET", "/admin/purges/2", nil))
+	if w.Code != 404 {
+		t.Errorf("Expected code 404, got %v\n", w.Code)
+	}
+}
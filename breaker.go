@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	BreakerDefaultCooldown  = 10 * time.Second
+	BreakerDefaultThreshold = 10
+)
+
+// CircuitBreaker fails calls fast after a run of consecutive failures so that
+// a struggling Redis isn't hammered and callers don't pile up waiting on it.
+// Once cooldown has passed, a single trial call is let through, and its
+// success closes the breaker again. A nil breaker allows everything.
+type CircuitBreaker struct {
+	cooldown  time.Duration
+	threshold int
+
+	mutex    sync.Mutex
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+// Builds a circuit breaker configured by REDIS_BREAKER_THRESHOLD (a number of
+// consecutive failures, or 0 to disable the breaker) and
+// REDIS_BREAKER_COOLDOWN.
+func parseCircuitBreaker() (*CircuitBreaker, error) {
+	threshold := BreakerDefaultThreshold
+	if os.Getenv("REDIS_BREAKER_THRESHOLD") != "" {
+		var err error
+		threshold, err = strconv.Atoi(os.Getenv("REDIS_BREAKER_THRESHOLD"))
+		if err != nil || threshold < 0 {
+			return nil, fmt.Errorf("REDIS_BREAKER_THRESHOLD must be a non-negative integer")
+		}
+	}
+
+	if threshold == 0 {
+		return nil, nil
+	}
+
+	cooldown := BreakerDefaultCooldown
+	if os.Getenv("REDIS_BREAKER_COOLDOWN") != "" {
+		var err error
+		cooldown, err = time.ParseDuration(os.Getenv("REDIS_BREAKER_COOLDOWN"))
+		if err != nil || cooldown <= 0 {
+			return nil, fmt.Errorf("REDIS_BREAKER_COOLDOWN must be a duration like `10s`")
+		}
+	}
+
+	return NewCircuitBreaker(threshold, cooldown), nil
+}
+
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{cooldown: cooldown, threshold: threshold}
+}
+
+// Checks whether a call should be attempted. Every call that's allowed must
+// be followed by a Record of its result.
+func (b *CircuitBreaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.failures < b.threshold {
+		return true
+	}
+
+	if b.trial || time.Since(b.openedAt) < b.cooldown {
+		return false
+	}
+
+	b.trial = true
+	return true
+}
+
+// Checks whether calls are currently being failed fast. The breaker is
+// half-open rather than open once cooldown has passed so that callers send
+// the work that a trial call will be made with.
+func (b *CircuitBreaker) Open() bool {
+	if b == nil {
+		return false
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.failures >= b.threshold && time.Since(b.openedAt) < b.cooldown
+}
+
+func (b *CircuitBreaker) Record(err error) {
+	if b == nil {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.trial = false
+	if err == nil {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openedAt = time.Now()
+	}
+}
+
+// Checks whether an error came from being unable to talk to Redis (a network
+// error or timeout, a dropped connection, or an exhausted pool) as opposed
+// to a problem with the data being written, like a stored blob that can't
+// be decrypted. Only the former says anything about Redis's health.
+func redisUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	return err == io.EOF || err == io.ErrUnexpectedEOF || err == redis.ErrPoolExhausted
+}
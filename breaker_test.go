@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	breaker := NewCircuitBreaker(3, 20*time.Millisecond)
+	failure := fmt.Errorf("connection refused")
+
+	for i := 0; i < 2; i++ {
+		breaker.Allow()
+		breaker.Record(failure)
+	}
+
+	// a success resets the run of failures
+	breaker.Allow()
+	breaker.Record(nil)
+
+	for i := 0; i < 3; i++ {
+		if !breaker.Allow() {
+			t.Fatalf("Expected allow true before threshold, got false\n")
+		}
+		breaker.Record(failure)
+	}
+
+	if !breaker.Open() {
+		t.Errorf("Expected open true, got false\n")
+	}
+	if breaker.Allow() {
+		t.Errorf("Expected allow false while open, got true\n")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	if breaker.Open() {
+		t.Errorf("Expected open false once half-open, got true\n")
+	}
+
+	// only a single trial is let through after the cooldown
+	if !breaker.Allow() {
+		t.Errorf("Expected allow true after cooldown, got false\n")
+	}
+	if breaker.Allow() {
+		t.Errorf("Expected allow false during trial, got true\n")
+	}
+
+	breaker.Record(failure)
+	if breaker.Allow() {
+		t.Errorf("Expected allow false after failed trial, got true\n")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	breaker.Allow()
+	breaker.Record(nil)
+	if breaker.Open() {
+		t.Errorf("Expected open false after successful trial, got true\n")
+	}
+}
+
+func TestCircuitBreakerNil(t *testing.T) {
+	var breaker *CircuitBreaker
+	if !breaker.Allow() || breaker.Open() {
+		t.Errorf("Expected a nil breaker to allow everything\n")
+	}
+	breaker.Record(fmt.Errorf("error"))
+}
+
+func TestStoreGroupsCircuitOpen(t *testing.T) {
+	setup(t)
+
+	receiver := NewReceiver([]*IndexConf{conf}, connPool)
+	receiver.breaker = NewCircuitBreaker(1, time.Hour)
+	receiver.breaker.Allow()
+	receiver.breaker.Record(fmt.Errorf("connection refused"))
+
+	failed := receiver.storeGroups(StorageGroup{
+		conf: {"req1": [][]byte{[]byte("request_id=req1")}},
+	})
+	if failed != 1 {
+		t.Errorf("Expected %v failed, got %v\n", 1, failed)
+	}
+
+	_, ok, err := NewRetriever([]*IndexConf{conf}, connPool).Lookup("req1")
+	if err != nil {
+		t.Error(err)
+	}
+	if ok {
+		t.Errorf("Expected nothing stored while the circuit is open\n")
+	}
+}
+
+func TestReceiveMessageCircuitOpen(t *testing.T) {
+	receiver = NewReceiver([]*IndexConf{conf}, connPool)
+	receiver.breaker = NewCircuitBreaker(1, time.Minute)
+	receiver.breaker.Allow()
+	receiver.breaker.Record(fmt.Errorf("connection refused"))
+
+	w := httptest.NewRecorder()
+	receiveMessage(w, httptest.NewRequest("POST", "/messages",
+		strings.NewReader("request_id=req1")))
+	if w.Code != 503 {
+		t.Errorf("Expected code 503, got %v\n", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "60" {
+		t.Errorf("Expected Retry-After %v, got %v\n", "60", w.Header().Get("Retry-After"))
+	}
+	if len(receiver.MessagesChan) != 0 {
+		t.Errorf("Expected nothing queued, got %v\n", len(receiver.MessagesChan))
+	}
+}
+
+func TestReceiveMessageCircuitRecovers(t *testing.T) {
+	setup(t)
+
+	// connections fail until Redis is marked as back up
+	var up int32
+	dial := redisConnect("redis://localhost:6379", nil)
+	pool := redis.NewPool(func() (redis.Conn, error) {
+		if atomic.LoadInt32(&up) == 0 {
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: fmt.Errorf("connection refused")}
+		}
+		return dial()
+	}, 1)
+
+	receiver = NewReceiver([]*IndexConf{conf}, pool)
+	receiver.breaker = NewCircuitBreaker(1, 50*time.Millisecond)
+	receiver.Run()
+	defer close(receiver.MessagesChan)
+
+	post := func(message string) int {
+		line := "<40>1 2012-11-30T06:45:29+00:00 host app web.3 - " + message
+		body := fmt.Sprintf("%v %v", len(line), line)
+
+		w := httptest.NewRecorder()
+		receiveMessage(w, httptest.NewRequest("POST", "/messages",
+			strings.NewReader(body)))
+		return w.Code
+	}
+
+	if code := post("request_id=req1"); code != 200 {
+		t.Fatalf("Expected code 200, got %v\n", code)
+	}
+	for i := 0; i < 100 && !receiver.breaker.Open(); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if code := post("request_id=req2"); code != 503 {
+		t.Fatalf("Expected code 503 while open, got %v\n", code)
+	}
+
+	atomic.StoreInt32(&up, 1)
+	time.Sleep(60 * time.Millisecond)
+
+	if code := post("request_id=req3"); code != 200 {
+		t.Fatalf("Expected code 200 once the cooldown has passed, got %v\n", code)
+	}
+
+	retriever := NewRetriever([]*IndexConf{conf}, connPool)
+	var ok bool
+	for i := 0; i < 100 && !ok; i++ {
+		time.Sleep(time.Millisecond)
+
+		var err error
+		_, ok, err = retriever.Lookup("req3")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !ok {
+		t.Errorf("Expected ingestion to resume after the cooldown\n")
+	}
+	if receiver.breaker.Open() {
+		t.Errorf("Expected open false after a successful trial, got true\n")
+	}
+}
+
+func TestStoreGroupBadDataKeepsBreakerClosed(t *testing.T) {
+	setup(t)
+
+	conn := connPool.Get()
+	defer conn.Close()
+
+	// a blob that doesn't decrypt, like one written with a retired key
+	_, err := conn.Do("SET", buildKey(conf.key, "req1"), append(encryptedMagic, "garbage"...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver := NewReceiver([]*IndexConf{conf}, connPool)
+	receiver.breaker = NewCircuitBreaker(1, time.Hour)
+
+	if receiver.storeGroup(conf, "req1", [][]byte{[]byte("request_id=req1")}) {
+		t.Errorf("Expected the write to fail\n")
+	}
+	if receiver.breaker.Open() {
+		t.Errorf("Expected open false after a data error, got true\n")
+	}
+}
+
+func TestRedisUnavailable(t *testing.T) {
+	cases := []struct {
+		err      error
+		expected bool
+	}{
+		{nil, false},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: fmt.Errorf("connection refused")}, true},
+		{io.EOF, true},
+		{redis.ErrPoolExhausted, true},
+		{fmt.Errorf("Blob has a truncated codec header"), false},
+		{redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value"), false},
+	}
+
+	for _, c := range cases {
+		if actual := redisUnavailable(c.err); actual != c.expected {
+			t.Errorf("Expected %v to be unavailable %v, got %v\n", c.err, c.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ClientDefaultURL    = "http://localhost:5000"
+	ClientTimeout       = 30 * time.Second
+	TailDefaultInterval = 2 * time.Second
+
+	OutputJSON   = "json"
+	OutputLogfmt = "logfmt"
+	OutputRaw    = "raw"
+
+	colorBold  = "\x1b[1m"
+	colorKey   = "\x1b[36m"
+	colorReset = "\x1b[0m"
+)
+
+var (
+	logfmtKeyPattern = regexp.MustCompile(`(^|\s)([^\s="]+)=`)
+)
+
+// Client talks to a running lvat over HTTP using the same API key that it
+// was deployed with.
+type Client struct {
+	apiKey string
+	http   *http.Client
+	url    string
+}
+
+func NewClient(baseURL string, apiKey string) *Client {
+	return &Client{
+		apiKey: apiKey,
+		http:   &http.Client{Timeout: ClientTimeout},
+		url:    baseURL,
+	}
+}
+
+// Gets the lines stored for a value that were appended after a cursor (see
+// tailBlob), along with the cursor for the end of them.
+func (c *Client) Lookup(query string, after int) ([]byte, int, bool, error) {
+	params := url.Values{"query": {query}}
+	if after > 0 {
+		params.Set("after", strconv.Itoa(after))
+	}
+
+	resp, err := c.get("/messages", params)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 404 {
+		return nil, 0, false, nil
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	cursor, _ := strconv.Atoi(resp.Header.Get("X-Lvat-Cursor"))
+	return data, cursor, true, nil
+}
+
+func (c *Client) Search(query string, index string, since time.Duration,
+	limit int) ([]*SearchResult, error) {
+
+	params := url.Values{"q": {query}}
+	if index != "" {
+		params.Set("index", index)
+	}
+	if since > 0 {
+		params.Set("since", since.String())
+	}
+	if limit > 0 {
+		params.Set("limit", strconv.Itoa(limit))
+	}
+
+	resp, err := c.get("/search", params)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Results []*SearchResult `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return body.Results, nil
+}
+
+func (c *Client) Stats() ([]*IndexStats, error) {
+	resp, err := c.get("/stats", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Indexes []*IndexStats `json:"indexes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return body.Indexes, nil
+}
+
+// Gets the lines of a value along with those of every value linked to it.
+func (c *Client) Trace(query string) ([]byte, bool, error) {
+	resp, err := c.get("/trace", url.Values{"query": {query}})
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 404 {
+		return nil, false, nil
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	return data, true, err
+}
+
+// Makes an authenticated GET request. Responses other than successes and not
+// founds are turned into errors.
+func (c *Client) get(path string, params url.Values) (*http.Response, error) {
+	u := c.url + path
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth("", c.apiKey)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 && resp.StatusCode != 404 {
+		message, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("Request to %s failed with status %v: %s",
+			path, resp.StatusCode, bytes.TrimSpace(message))
+	}
+	return resp, nil
+}
+
+// Printer writes lines and results in one of the output modes.
+type Printer struct {
+	mode string
+	out  io.Writer
+}
+
+func NewPrinter(mode string, out io.Writer) (*Printer, error) {
+	switch mode {
+	case OutputJSON, OutputLogfmt, OutputRaw:
+	default:
+		return nil, fmt.Errorf("Unknown output mode: %s", mode)
+	}
+	return &Printer{mode: mode, out: out}, nil
+}
+
+// Prints each of a block of newline-separated lines.
+func (p *Printer) PrintLines(data []byte) {
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(line) > 0 {
+			p.PrintLine(line)
+		}
+	}
+}
+
+// Prints a line as is in raw mode, with its keys colourised in logfmt mode,
+// or as an object with its parsed pairs in JSON mode.
+func (p *Printer) PrintLine(line []byte) {
+	switch p.mode {
+	case OutputJSON:
+		message := &LogMessage{data: line, pairs: make(map[string]string)}
+		parsers["auto"].Parse(message)
+		p.PrintJSON(map[string]interface{}{
+			"line":  string(line),
+			"pairs": message.pairs,
+		})
+	case OutputLogfmt:
+		fmt.Fprintf(p.out, "%s\n", colorizeLogfmt(line))
+	default:
+		fmt.Fprintf(p.out, "%s\n", line)
+	}
+}
+
+func (p *Printer) PrintJSON(v interface{}) {
+	json.NewEncoder(p.out).Encode(v)
+}
+
+// Highlights the keys of logfmt pairs in a line, leaving everything else
+// exactly as it was.
+func colorizeLogfmt(line []byte) []byte {
+	return logfmtKeyPattern.ReplaceAll(line, []byte("${1}"+colorKey+"${2}"+colorReset+"="))
+}
+
+// Chooses logfmt for terminals, and raw output otherwise so that lines can
+// be piped into other tools.
+func defaultOutputMode() string {
+	info, err := os.Stdout.Stat()
+	if err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		return OutputLogfmt
+	}
+	return OutputRaw
+}
+
+// Runs one of the client subcommands (`get`, `search`, `stats`, or `tail`).
+// The lvat to talk to and its key come from LVAT_URL and API_KEY unless
+// given as flags.
+func runClient(command string, args []string) error {
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	baseURL := flags.String("url", os.Getenv("LVAT_URL"), "URL of the lvat to query (defaults to LVAT_URL)")
+	apiKey := flags.String("key", os.Getenv("API_KEY"), "API key (defaults to API_KEY)")
+	mode := flags.String("o", defaultOutputMode(), "output mode: raw, logfmt, or json")
+
+	// command specific flags
+	index := flags.String("index", "", "index to search (search)")
+	interval := flags.Duration("interval", TailDefaultInterval, "time between polls (tail)")
+	limit := flags.Int("limit", 0, "maximum number of results (search)")
+	since := flags.Duration("since", 0, "only search values written within this duration (search)")
+	trace := flags.Bool("trace", false, "include lines of linked values (get)")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *baseURL == "" {
+		*baseURL = ClientDefaultURL
+	}
+
+	printer, err := NewPrinter(*mode, os.Stdout)
+	if err != nil {
+		return err
+	}
+
+	client := NewClient(*baseURL, *apiKey)
+
+	switch command {
+	case "get":
+		if flags.NArg() != 1 {
+			return fmt.Errorf("Usage: lvat get [flags] <value>")
+		}
+		return clientGet(client, printer, flags.Arg(0), *trace)
+	case "search":
+		if flags.NArg() < 1 {
+			return fmt.Errorf("Usage: lvat search [flags] <query>")
+		}
+		return clientSearch(client, printer, flags.Args(), *index, *since, *limit)
+	case "stats":
+		return clientStats(client, printer)
+	case "tail":
+		if flags.NArg() != 1 {
+			return fmt.Errorf("Usage: lvat tail [flags] <value>")
+		}
+		return clientTail(client, printer, flags.Arg(0), *interval, nil)
+	}
+
+	return fmt.Errorf("Unknown command: %s", command)
+}
+
+func clientGet(client *Client, printer *Printer, query string, trace bool) error {
+	var data []byte
+	var ok bool
+	var err error
+	if trace {
+		data, ok, err = client.Trace(query)
+	} else {
+		data, _, ok, err = client.Lookup(query, 0)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return fmt.Errorf("Not found: %s", query)
+	}
+
+	printer.PrintLines(data)
+	return nil
+}
+
+func clientSearch(client *Client, printer *Printer, terms []string, index string,
+	since time.Duration, limit int) error {
+
+	results, err := client.Search(strings.Join(terms, " "), index, since, limit)
+	if err != nil {
+		return err
+	}
+
+	if printer.mode == OutputJSON {
+		printer.PrintJSON(results)
+		return nil
+	}
+
+	for _, result := range results {
+		if printer.mode == OutputLogfmt {
+			fmt.Fprintf(printer.out, "%s%s%s\n", colorBold, result.Value, colorReset)
+		}
+		for _, line := range result.Lines {
+			printer.PrintLine([]byte(line))
+		}
+	}
+	return nil
+}
+
+func clientStats(client *Client, printer *Printer) error {
+	stats, err := client.Stats()
+	if err != nil {
+		return err
+	}
+
+	if printer.mode == OutputJSON {
+		printer.PrintJSON(stats)
+		return nil
+	}
+
+	for _, s := range stats {
+		line := fmt.Sprintf("index=%v recent_keys=%v feed_keys=%v keys_created=%v "+
+			"keys_truncated=%v lines_written=%v lines_dropped=%v",
+			s.Index, s.RecentKeys, s.FeedKeys, s.KeysCreated,
+			s.KeysTruncated, s.LinesWritten, s.LinesDropped)
+		if s.IndexSample != nil {
+			line += fmt.Sprintf(" keys=%v total_bytes=%v average_bytes=%v "+
+				"memory_bytes=%v compression_ratio=%.2f",
+				s.Keys, s.TotalBytes, s.AverageBytes, s.MemoryBytes, s.CompressionRatio)
+		}
+		printer.PrintLine([]byte(line))
+	}
+	return nil
+}
+
+// Polls for lines appended to a value and prints them until stop is closed
+// (or forever if it's nil). Values that don't exist yet are waited for.
+func clientTail(client *Client, printer *Printer, query string,
+	interval time.Duration, stop <-chan struct{}) error {
+
+	cursor := 0
+	for {
+		data, end, ok, err := client.Lookup(query, cursor)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			printer.PrintLines(data)
+			cursor = end
+		}
+
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
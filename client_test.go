@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T) (*Receiver, *httptest.Server) {
+	setup(t)
+
+	receiver := NewReceiver([]*IndexConf{conf}, connPool)
+	retriever = NewRetriever([]*IndexConf{conf}, connPool)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if basicAuthPassword(r) != "secret" {
+			w.WriteHeader(401)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/messages":
+			lookupMessages(w, r)
+		case "/search":
+			searchMessages(w, r)
+		case "/stats":
+			showStats(w, r)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	return receiver, server
+}
+
+func TestClientLookup(t *testing.T) {
+	receiver, server := newTestServer(t)
+	defer server.Close()
+
+	client := NewClient(server.URL, "secret")
+
+	_, _, ok, err := client.Lookup("req1", 0)
+	if err != nil {
+		t.Error(err)
+	}
+	if ok {
+		t.Errorf("Expected found false, got true\n")
+	}
+
+	_, err = receiver.compress(conf, "req1", [][]byte{[]byte("request_id=req1 n=1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, cursor, ok, err := client.Lookup("req1", 0)
+	if err != nil {
+		t.Error(err)
+	}
+	if !ok {
+		t.Fatalf("Expected found true, got false\n")
+	}
+	if string(data) != "request_id=req1 n=1\n" {
+		t.Errorf("Expected data %q, got %q\n", "request_id=req1 n=1\n", string(data))
+	}
+	if cursor != 1 {
+		t.Errorf("Expected cursor %v, got %v\n", 1, cursor)
+	}
+
+	_, _, _, err = NewClient(server.URL, "wrong").Lookup("req1", 0)
+	if err == nil {
+		t.Errorf("Expected an error for a bad key\n")
+	}
+}
+
+func TestClientSearch(t *testing.T) {
+	_, server := newTestServer(t)
+	defer server.Close()
+
+	searchConf := &IndexConf{
+		key:       "request_id",
+		maxSize:   2,
+		recentMax: 10,
+		searchMax: 10,
+		ttl:       1 * time.Hour,
+	}
+	receiver := NewReceiver([]*IndexConf{searchConf}, connPool)
+
+	for value, line := range map[string]string{
+		"req1": "request_id=req1 at=error",
+		"req2": "request_id=req2 at=info",
+	} {
+		lines := [][]byte{[]byte(line)}
+		if !receiver.storeGroup(searchConf, value, lines) {
+			t.Fatalf("Couldn't store %v\n", value)
+		}
+	}
+
+	client := NewClient(server.URL, "secret")
+
+	results, err := client.Search("at=error", "request_id", 10*time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("Expected results length %v, got %v\n", 1, len(results))
+	}
+	if results[0].Value != "req1" {
+		t.Errorf("Expected value %v, got %v\n", "req1", results[0].Value)
+	}
+	if len(results[0].Lines) != 1 || results[0].Lines[0] != "request_id=req1 at=error" {
+		t.Errorf("Expected lines %v, got %v\n",
+			[]string{"request_id=req1 at=error"}, results[0].Lines)
+	}
+}
+
+func TestClientTail(t *testing.T) {
+	receiver, server := newTestServer(t)
+	defer server.Close()
+
+	var out bytes.Buffer
+	printer, _ := NewPrinter(OutputRaw, &out)
+	client := NewClient(server.URL, "secret")
+
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- clientTail(client, printer, "req1", 10*time.Millisecond, stop)
+	}()
+
+	for i := 1; i <= 2; i++ {
+		line := "request_id=req1 n=" + strconv.Itoa(i)
+		if _, err := receiver.compress(conf, "req1", [][]byte{[]byte(line)}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(30 * time.Millisecond)
+	}
+
+	close(stop)
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+
+	expected := "request_id=req1 n=1\nrequest_id=req1 n=2\n"
+	if out.String() != expected {
+		t.Errorf("Expected output %q, got %q\n", expected, out.String())
+	}
+}
+
+func TestClientStats(t *testing.T) {
+	_, server := newTestServer(t)
+	defer server.Close()
+
+	stats, err := NewClient(server.URL, "secret").Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 {
+		t.Fatalf("Expected %v indexes, got %v\n", 1, len(stats))
+	}
+	if stats[0].Index != "request_id" {
+		t.Errorf("Expected index %v, got %v\n", "request_id", stats[0].Index)
+	}
+}
+
+func TestPrinter(t *testing.T) {
+	line := []byte(`at=info msg="hello world"`)
+	cases := []struct {
+		mode     string
+		expected string
+	}{
+		{OutputRaw, "at=info msg=\"hello world\"\n"},
+		{OutputLogfmt, "\x1b[36mat\x1b[0m=info \x1b[36mmsg\x1b[0m=\"hello world\"\n"},
+		{OutputJSON, `{"line":"at=info msg=\"hello world\"","pairs":{"at":"info","msg":"hello world"}}` + "\n"},
+	}
+
+	for _, c := range cases {
+		var out bytes.Buffer
+		printer, err := NewPrinter(c.mode, &out)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		printer.PrintLine(line)
+		if out.String() != c.expected {
+			t.Errorf("Expected %v output %q, got %q\n", c.mode, c.expected, out.String())
+		}
+	}
+
+	_, err := NewPrinter("yaml", &bytes.Buffer{})
+	if err == nil || !strings.Contains(err.Error(), "yaml") {
+		t.Errorf("Expected an error for an unknown mode\n")
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Prefixes blobs compressed with any codec other than gzip, followed by a
+// byte with the length of the codec's tag and the tag itself. Blobs without
+// the prefix are gzip, which is how every blob was stored before codecs were
+// configurable.
+var codecMagic = []byte("lvC1")
+
+// Codec compresses and decompresses stored blobs.
+type Codec interface {
+	Compress(data []byte) ([]byte, error)
+
+	// The HTTP Content-Encoding of compressed blobs, or an empty string if
+	// they can't be served to clients directly.
+	ContentEncoding() string
+
+	Decompress(data []byte) ([]byte, error)
+
+	// Identifies the codec in the header of stored blobs.
+	Tag() string
+}
+
+// Blob is a stored blob's compressed data along with the codec that
+// compressed it.
+type Blob struct {
+	Codec Codec
+	Data  []byte
+
+	// When the blob was last written to, if known.
+	LastModified time.Time
+}
+
+var (
+	codecs = map[string]Codec{
+		"gzip":   NewGzipCodec(gzip.DefaultCompression),
+		"none":   &NoneCodec{},
+		"snappy": &SnappyCodec{},
+		"zstd":   mustZstdCodec(),
+	}
+)
+
+// Makes a codec available for decompressing blobs tagged with it.
+func registerCodec(codec Codec) {
+	codecs[codec.Tag()] = codec
+}
+
+// Gets the codec that a conf's blobs should be compressed with, which is
+// gzip unless otherwise configured.
+func confCodec(conf *IndexConf) Codec {
+	if conf.codec == nil {
+		return codecs["gzip"]
+	}
+	return conf.codec
+}
+
+// Looks up a codec by the tag stored in a blob's header.
+func findCodec(tag string) (Codec, error) {
+	codec, ok := codecs[tag]
+	if !ok {
+		return nil, fmt.Errorf("Unknown codec: %s", tag)
+	}
+	return codec, nil
+}
+
+// Parses a codec configuration string like `gzip`, `gzip:9`, or `zstd:3`,
+// where the optional number is the compression level.
+func parseCodec(conf string) (Codec, error) {
+	name := conf
+	level := 0
+	hasLevel := false
+	if i := strings.IndexRune(conf, ':'); i >= 0 {
+		var err error
+		name = conf[0:i]
+		level, err = strconv.Atoi(conf[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("Bad codec level: %s", conf)
+		}
+		hasLevel = true
+	}
+
+	switch name {
+	case "gzip":
+		if !hasLevel {
+			level = gzip.DefaultCompression
+		}
+		if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+			return nil, fmt.Errorf("Bad gzip level: %v", level)
+		}
+		return NewGzipCodec(level), nil
+	case "zstd":
+		if !hasLevel {
+			level = 3
+		}
+		return NewZstdCodec(level, nil)
+	case "none", "snappy":
+		if hasLevel {
+			return nil, fmt.Errorf("Codec %s doesn't take a level", name)
+		}
+		return findCodec(name)
+	}
+
+	return nil, fmt.Errorf("Unknown codec: %s", name)
+}
+
+// Parses a per-index codec configuration string of the form
+// `index=codec,...` (like `request_id=zstd:3`) into a map of conf keys to
+// the codec that their blobs should be compressed with.
+func parseIndexCodecs(conf string, confs []*IndexConf) (map[string]Codec, error) {
+	indexCodecs := make(map[string]Codec)
+	if conf == "" {
+		return indexCodecs, nil
+	}
+
+	for _, pair := range strings.Split(conf, ",") {
+		i := strings.IndexRune(pair, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("Bad index codec pair: %s", pair)
+		}
+
+		key := pair[0:i]
+		known := false
+		for _, c := range confs {
+			known = known || c.key == key
+		}
+		if !known {
+			return nil, fmt.Errorf("Unknown index: %s", key)
+		}
+
+		codec, err := parseCodec(pair[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		indexCodecs[key] = codec
+	}
+
+	return indexCodecs, nil
+}
+
+// Splits a stored (and decrypted) blob into its codec and compressed data.
+func decodeBlob(data []byte) (*Blob, error) {
+	if !bytes.HasPrefix(data, codecMagic) {
+		return &Blob{Codec: codecs["gzip"], Data: data}, nil
+	}
+
+	header := data[len(codecMagic):]
+	if len(header) < 1 || len(header) < 1+int(header[0]) {
+		return nil, fmt.Errorf("Blob has a truncated codec header")
+	}
+
+	codec, err := findCodec(string(header[1 : 1+int(header[0])]))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Blob{Codec: codec, Data: header[1+int(header[0]):]}, nil
+}
+
+// Produces the stored form of a blob, tagging it with its codec.
+func encodeBlob(blob *Blob) []byte {
+	tag := blob.Codec.Tag()
+	if tag == "gzip" {
+		return blob.Data
+	}
+
+	var buffer bytes.Buffer
+	buffer.Write(codecMagic)
+	buffer.WriteByte(byte(len(tag)))
+	buffer.WriteString(tag)
+	buffer.Write(blob.Data)
+	return buffer.Bytes()
+}
+
+func (b *Blob) Decompress() ([]byte, error) {
+	return b.Codec.Decompress(b.Data)
+}
+
+// Re-encodes a blob with a different codec.
+func (b *Blob) Transcode(codec Codec) (*Blob, error) {
+	if b.Codec.Tag() == codec.Tag() {
+		return b, nil
+	}
+
+	data, err := b.Decompress()
+	if err != nil {
+		return nil, err
+	}
+
+	compressed, err := codec.Compress(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Blob{Codec: codec, Data: compressed}, nil
+}
+
+type GzipCodec struct {
+	level int
+}
+
+func NewGzipCodec(level int) *GzipCodec {
+	return &GzipCodec{level: level}
+}
+
+func (c *GzipCodec) Compress(data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer, err := gzip.NewWriterLevel(&buffer, c.level)
+	if err != nil {
+		return nil, err
+	}
+
+	writer.Write(data)
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (c *GzipCodec) ContentEncoding() string {
+	return "gzip"
+}
+
+func (c *GzipCodec) Decompress(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewBuffer(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+func (c *GzipCodec) Tag() string {
+	return "gzip"
+}
+
+// NoneCodec stores blobs uncompressed.
+type NoneCodec struct{}
+
+func (c *NoneCodec) Compress(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func (c *NoneCodec) ContentEncoding() string {
+	return "identity"
+}
+
+func (c *NoneCodec) Decompress(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func (c *NoneCodec) Tag() string {
+	return "none"
+}
+
+// SnappyCodec stores blobs in the Snappy block format. It's fast, but has
+// no standard Content-Encoding, so blobs are always transcoded when served.
+type SnappyCodec struct{}
+
+func (c *SnappyCodec) Compress(data []byte) ([]byte, error) {
+	return s2.EncodeSnappy(nil, data), nil
+}
+
+func (c *SnappyCodec) ContentEncoding() string {
+	return ""
+}
+
+func (c *SnappyCodec) Decompress(data []byte) ([]byte, error) {
+	return s2.Decode(nil, data)
+}
+
+func (c *SnappyCodec) Tag() string {
+	return "snappy"
+}
+
+// ZstdCodec stores blobs with Zstandard, optionally using a dictionary. Log
+// lines are very repetitive across keys, so a dictionary trained on them
+// substantially improves compression of small blobs.
+type ZstdCodec struct {
+	decoder *zstd.Decoder
+	dict    []byte
+	dictID  uint32
+	encoder *zstd.Encoder
+}
+
+func NewZstdCodec(level int, dict []byte) (*ZstdCodec, error) {
+	encoderOptions := []zstd.EOption{
+		zstd.WithEncoderConcurrency(1),
+		zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)),
+	}
+	decoderOptions := []zstd.DOption{
+		zstd.WithDecoderConcurrency(1),
+	}
+	var dictID uint32
+	if dict != nil {
+		info, err := zstd.InspectDictionary(dict)
+		if err != nil {
+			return nil, err
+		}
+		dictID = info.ID()
+
+		encoderOptions = append(encoderOptions, zstd.WithEncoderDict(dict))
+		decoderOptions = append(decoderOptions, zstd.WithDecoderDicts(dict))
+	}
+
+	encoder, err := zstd.NewWriter(nil, encoderOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder, err := zstd.NewReader(nil, decoderOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ZstdCodec{
+		decoder: decoder,
+		dict:    dict,
+		dictID:  dictID,
+		encoder: encoder,
+	}, nil
+}
+
+func mustZstdCodec() *ZstdCodec {
+	codec, err := NewZstdCodec(3, nil)
+	if err != nil {
+		panic(err)
+	}
+	return codec
+}
+
+func (c *ZstdCodec) Compress(data []byte) ([]byte, error) {
+	return c.encoder.EncodeAll(data, nil), nil
+}
+
+// Blobs compressed with a dictionary can't be decoded by clients that don't
+// have it, so they're only served directly when no dictionary is in use.
+func (c *ZstdCodec) ContentEncoding() string {
+	if c.dict != nil {
+		return ""
+	}
+	return "zstd"
+}
+
+func (c *ZstdCodec) Decompress(data []byte) ([]byte, error) {
+	return c.decoder.DecodeAll(data, nil)
+}
+
+// Blobs compressed with a dictionary are tagged with its ID so that they can
+// only be decompressed with the same dictionary.
+func (c *ZstdCodec) Tag() string {
+	if c.dict != nil {
+		return fmt.Sprintf("zstd-%d", c.dictID)
+	}
+	return "zstd"
+}
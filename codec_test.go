@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCodecs(t *testing.T) {
+	data := bytes.Repeat([]byte("request_id=req1 at=info\n"), 10)
+
+	for tag, codec := range codecs {
+		compressed, err := codec.Compress(data)
+		if err != nil {
+			t.Error(err)
+		}
+
+		blob, err := decodeBlob(encodeBlob(&Blob{Codec: codec, Data: compressed}))
+		if err != nil {
+			t.Error(err)
+		}
+		if blob.Codec.Tag() != tag {
+			t.Errorf("Expected codec %v, got %v\n", tag, blob.Codec.Tag())
+		}
+
+		decompressed, err := blob.Decompress()
+		if err != nil {
+			t.Error(err)
+		}
+		if !bytes.Equal(data, decompressed) {
+			t.Errorf("Expected %v round trip '%v', got '%v'\n", tag,
+				string(data), string(decompressed))
+		}
+
+		transcoded, err := blob.Transcode(codecs["gzip"])
+		if err != nil {
+			t.Error(err)
+		}
+		decompressed, err = transcoded.Decompress()
+		if err != nil {
+			t.Error(err)
+		}
+		if !bytes.Equal(data, decompressed) {
+			t.Errorf("Expected %v transcode '%v', got '%v'\n", tag,
+				string(data), string(decompressed))
+		}
+	}
+}
+
+func TestEncodeBlobGzip(t *testing.T) {
+	// gzip blobs are stored without a header as they were before codecs
+	compressed, err := codecs["gzip"].Compress([]byte("request_id=req1\n"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	encoded := encodeBlob(&Blob{Codec: codecs["gzip"], Data: compressed})
+	if !bytes.Equal(compressed, encoded) {
+		t.Errorf("Expected gzip blob to be stored without a header\n")
+	}
+}
+
+func TestParseCodec(t *testing.T) {
+	valid := map[string]string{
+		"gzip":   "gzip",
+		"gzip:9": "gzip",
+		"zstd":   "zstd",
+		"zstd:1": "zstd",
+		"snappy": "snappy",
+		"none":   "none",
+	}
+	for conf, tag := range valid {
+		codec, err := parseCodec(conf)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if codec.Tag() != tag {
+			t.Errorf("Expected codec %v, got %v\n", tag, codec.Tag())
+		}
+	}
+
+	for _, conf := range []string{"brotli", "gzip:x", "gzip:10", "none:1"} {
+		if _, err := parseCodec(conf); err == nil {
+			t.Errorf("Expected error for codec %v\n", conf)
+		}
+	}
+}
+
+func TestParseIndexCodecs(t *testing.T) {
+	indexConfs := []*IndexConf{{key: "request_id"}, {key: "user_id"}}
+
+	indexCodecs, err := parseIndexCodecs("request_id=zstd:3,user_id=snappy", indexConfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if indexCodecs["request_id"].Tag() != "zstd" {
+		t.Errorf("Expected codec %v, got %v\n", "zstd", indexCodecs["request_id"].Tag())
+	}
+	if indexCodecs["user_id"].Tag() != "snappy" {
+		t.Errorf("Expected codec %v, got %v\n", "snappy", indexCodecs["user_id"].Tag())
+	}
+
+	for _, conf := range []string{"request_id", "app_id=gzip", "request_id=brotli"} {
+		if _, err := parseIndexCodecs(conf, indexConfs); err == nil {
+			t.Errorf("Expected error for index codecs %v\n", conf)
+		}
+	}
+}
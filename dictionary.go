@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/klauspost/compress/dict"
+)
+
+const (
+	DictionaryDefaultSamples = 5000
+	DictionaryDefaultSize    = 64 * 1024
+
+	// Every nth sample is held out of training and used to evaluate the
+	// dictionary instead.
+	DictionaryHoldout = 5
+)
+
+type DictionaryReport struct {
+	Codec string
+	Ratio float64
+	Size  int
+}
+
+// Compresses each sample separately (just as each key is stored separately)
+// with a set of codecs and reports the total compressed size and ratio for
+// each.
+func evaluateDictionary(samples [][]byte, candidates []Codec) []*DictionaryReport {
+	total := 0
+	for _, sample := range samples {
+		total += len(sample)
+	}
+
+	reports := make([]*DictionaryReport, len(candidates))
+	for i, codec := range candidates {
+		size := 0
+		for _, sample := range samples {
+			compressed, err := codec.Compress(sample)
+			if err != nil {
+				continue
+			}
+			size += len(compressed)
+		}
+
+		ratio := 0.0
+		if size > 0 {
+			ratio = float64(total) / float64(size)
+		}
+
+		reports[i] = &DictionaryReport{Codec: codec.Tag(), Ratio: ratio, Size: size}
+	}
+	return reports
+}
+
+// Loads every dictionary (`*.zdict`) in a directory and registers a codec
+// for each so that blobs compressed with any of them can be read. Old
+// dictionaries should be kept around after retraining for as long as blobs
+// compressed with them might still be stored.
+func loadDictionaries(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.zdict"))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		if _, err := loadDictionary(path, 3); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Loads a dictionary and registers a codec for it.
+func loadDictionary(path string, level int) (*ZstdCodec, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	codec, err := NewZstdCodec(level, data)
+	if err != nil {
+		return nil, fmt.Errorf("Bad dictionary %s: %s", path, err.Error())
+	}
+
+	registerCodec(codec)
+	return codec, nil
+}
+
+// Reads samples from a file, one per line.
+func sampleFile(path string, max int) ([][]byte, error) {
+	var reader io.Reader
+	if path == "-" {
+		reader = os.Stdin
+	} else {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		reader = file
+	}
+
+	samples := make([][]byte, 0)
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() && len(samples) < max {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" {
+			samples = append(samples, []byte(line+"\n"))
+		}
+	}
+	return samples, scanner.Err()
+}
+
+// Reads samples from the traces currently stored for each conf, one per key.
+func sampleStoredTraces(retriever *Retriever, max int) ([][]byte, error) {
+	conn := retriever.connPool.Get()
+	defer conn.Close()
+
+	samples := make([][]byte, 0)
+	for _, conf := range retriever.confs {
+		cursor := 0
+		for len(samples) < max {
+			values, err := redis.Values(conn.Do("SCAN", cursor,
+				"MATCH", buildKey(conf.key, "*"), "COUNT", 100))
+			if err != nil {
+				return nil, err
+			}
+
+			cursor, _ = redis.Int(values[0], nil)
+			keys, _ := redis.Strings(values[1], nil)
+			for _, key := range keys {
+				if len(samples) >= max {
+					break
+				}
+
+				blob, ok, err := retriever.lookupKey(conn, key)
+				if err != nil || !ok {
+					continue
+				}
+
+				data, err := blob.Decompress()
+				if err != nil {
+					continue
+				}
+				samples = append(samples, data)
+			}
+
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+	return samples, nil
+}
+
+// Trains a dictionary from samples of stored traces or a local file, writes
+// it out, and reports how it compares to the existing codecs on samples that
+// were held out of training.
+func trainDict(args []string) error {
+	flags := flag.NewFlagSet("train-dict", flag.ContinueOnError)
+	id := flags.Uint("id", 0, "dictionary ID (random if zero)")
+	input := flags.String("input", "", "file to sample lines from (- for stdin) instead of Redis")
+	numSamples := flags.Int("samples", DictionaryDefaultSamples, "maximum number of samples")
+	output := flags.String("o", "", "path to write the dictionary to (defaults to <id>.zdict)")
+	size := flags.Int("size", DictionaryDefaultSize, "maximum dictionary size in bytes")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var samples [][]byte
+	var err error
+	if *input != "" {
+		samples, err = sampleFile(*input, *numSamples)
+	} else {
+		redisUrl := os.Getenv("REDIS_URL")
+		if redisUrl == "" {
+			return fmt.Errorf("Need REDIS_URL or -input")
+		}
+
+		if os.Getenv("ZSTD_DICTIONARY_DIR") != "" {
+			if err := loadDictionaries(os.Getenv("ZSTD_DICTIONARY_DIR")); err != nil {
+				return err
+			}
+		}
+
+		pool := redis.NewPool(redisConnect(redisUrl, nil), 1)
+		defer pool.Close()
+
+		sampler := NewRetriever(confs, pool)
+		sampler.encryptor, err = parseEncryptionKeys(os.Getenv("ENCRYPTION_KEYS"))
+		if err != nil {
+			return err
+		}
+
+		samples, err = sampleStoredTraces(sampler, *numSamples)
+	}
+	if err != nil {
+		return err
+	}
+
+	training := make([][]byte, 0, len(samples))
+	holdout := make([][]byte, 0, len(samples)/DictionaryHoldout)
+	for i, sample := range samples {
+		if i%DictionaryHoldout == DictionaryHoldout-1 {
+			holdout = append(holdout, sample)
+		} else {
+			training = append(training, sample)
+		}
+	}
+
+	if len(training) == 0 {
+		return fmt.Errorf("No samples to train with")
+	}
+
+	data, err := dict.BuildZstdDict(training, dict.Options{
+		HashBytes:   6,
+		MaxDictSize: *size,
+		ZstdDictID:  uint32(*id),
+	})
+	if err != nil {
+		return err
+	}
+
+	codec, err := NewZstdCodec(3, data)
+	if err != nil {
+		return err
+	}
+
+	path := *output
+	if path == "" {
+		path = fmt.Sprintf("%d.zdict", codec.dictID)
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return err
+	}
+
+	fmt.Printf("train_dict id=%v path=%v samples=%v size=%v\n",
+		codec.dictID, path, len(training), len(data))
+
+	for _, report := range evaluateDictionary(holdout,
+		[]Codec{codecs["gzip"], codecs["zstd"], codec}) {
+
+		fmt.Printf("evaluate codec=%v samples=%v bytes=%v ratio=%.2f\n",
+			report.Codec, len(holdout), report.Size, report.Ratio)
+	}
+
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/dict"
+)
+
+// Generates traces that look like router output, each made up of a few
+// lines for a single request.
+func generateTraces(n int, seed int64) [][]byte {
+	random := rand.New(rand.NewSource(seed))
+	traces := make([][]byte, n)
+	for i := 0; i < n; i++ {
+		requestID := fmt.Sprintf("%08x-%04x-%04x", random.Uint32(),
+			random.Intn(65536), random.Intn(65536))
+
+		var trace bytes.Buffer
+		for j := 0; j < 1+random.Intn(3); j++ {
+			fmt.Fprintf(&trace, "at=info method=GET path=\"/apps/%v/releases\" "+
+				"host=api.heroku.com request_id=%v dyno=web.%v connect=%vms "+
+				"service=%vms status=%v bytes=%v\n",
+				random.Intn(10000), requestID, 1+random.Intn(20), random.Intn(5),
+				random.Intn(900), []int{200, 201, 404, 500}[random.Intn(4)],
+				random.Intn(9000))
+		}
+		traces[i] = trace.Bytes()
+	}
+	return traces
+}
+
+func trainTestDictionary(t testing.TB, id uint32, seed int64) []byte {
+	data, err := dict.BuildZstdDict(generateTraces(200, seed), dict.Options{
+		HashBytes:   6,
+		MaxDictSize: 16 * 1024,
+		ZstdDictID:  id,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestDictionaryVersioning(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lvat-dicts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldDict := trainTestDictionary(t, 1001, 1)
+	newDict := trainTestDictionary(t, 1002, 2)
+
+	oldCodec, err := NewZstdCodec(3, oldDict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oldCodec.Tag() != "zstd-1001" {
+		t.Errorf("Expected tag %v, got %v\n", "zstd-1001", oldCodec.Tag())
+	}
+	if oldCodec.ContentEncoding() != "" {
+		t.Errorf("Expected dictionary blobs not to be served directly\n")
+	}
+
+	data := generateTraces(1, 3)[0]
+	compressed, err := oldCodec.Compress(data)
+	if err != nil {
+		t.Error(err)
+	}
+	stored := encodeBlob(&Blob{Codec: oldCodec, Data: compressed})
+
+	// after retraining, both dictionaries are deployed
+	for name, d := range map[string][]byte{"1001.zdict": oldDict, "1002.zdict": newDict} {
+		err = ioutil.WriteFile(filepath.Join(dir, name), d, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = loadDictionaries(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blob, err := decodeBlob(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blob.Codec.Tag() != "zstd-1001" {
+		t.Errorf("Expected codec %v, got %v\n", "zstd-1001", blob.Codec.Tag())
+	}
+
+	decompressed, err := blob.Decompress()
+	if err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(data, decompressed) {
+		t.Errorf("Expected '%v', got '%v'\n", string(data), string(decompressed))
+	}
+
+	if _, err = findCodec("zstd-1002"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEvaluateDictionary(t *testing.T) {
+	codec, err := NewZstdCodec(3, trainTestDictionary(t, 1003, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reports := evaluateDictionary(generateTraces(100, 4),
+		[]Codec{codecs["gzip"], codec})
+	if len(reports) != 2 {
+		t.Fatalf("Expected reports length %v, got %v\n", 2, len(reports))
+	}
+	if reports[1].Ratio <= reports[0].Ratio {
+		t.Errorf("Expected dictionary ratio %.2f to beat gzip ratio %.2f\n",
+			reports[1].Ratio, reports[0].Ratio)
+	}
+}
+
+// Reports the compression ratio of small traces compressed with a trained
+// dictionary compared to the gzip blobs stored by default.
+func BenchmarkDictionaryCompression(b *testing.B) {
+	codec, err := NewZstdCodec(3, trainTestDictionary(b, 1004, 1))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	traces := generateTraces(1000, 5)
+	candidates := []Codec{codecs["gzip"], codecs["zstd"], codec}
+	names := []string{"gzip", "zstd", "zstd-dict"}
+
+	var reports []*DictionaryReport
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reports = evaluateDictionary(traces, candidates)
+	}
+
+	for i, report := range reports {
+		b.ReportMetric(report.Ratio, names[i]+"-ratio")
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Prefixes every encrypted blob so that it can be distinguished from the
+// plain gzip blobs stored before encryption was enabled.
+var encryptedMagic = []byte("lvE1")
+
+// Encryptor seals stored blobs with AES-GCM. Each blob carries a small
+// header with the ID of the key that encrypted it so that keys can be
+// rotated: new blobs are always encrypted with the current key, while any
+// key that's still configured can be used for decryption.
+//
+// The blob's Redis key is used as additional authenticated data so that an
+// encrypted blob can't be moved to a different key and still be read.
+//
+// Search tokens and tag values end up in the names of Redis keys, which
+// can't be encrypted, so they're replaced by an HMAC under a key derived
+// from the current key instead. Lookups hash their terms the same way.
+type Encryptor struct {
+	currentKeyID string
+	indexKey     []byte
+	keys         map[string]cipher.AEAD
+}
+
+func NewEncryptor(keys map[string][]byte, currentKeyID string) (*Encryptor, error) {
+	if _, ok := keys[currentKeyID]; !ok {
+		return nil, fmt.Errorf("No key with ID: %s", currentKeyID)
+	}
+
+	// derived rather than used directly so that the key that encrypts
+	// blobs is never used for anything else
+	mac := hmac.New(sha256.New, keys[currentKeyID])
+	mac.Write([]byte("lvat index tokens"))
+
+	e := &Encryptor{
+		currentKeyID: currentKeyID,
+		indexKey:     mac.Sum(nil),
+		keys:         make(map[string]cipher.AEAD),
+	}
+
+	for keyID, key := range keys {
+		if len(keyID) == 0 || len(keyID) > 255 {
+			return nil, fmt.Errorf("Key ID must be 1 to 255 bytes: %s", keyID)
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		e.keys[keyID] = aead
+	}
+
+	return e, nil
+}
+
+// Parses a configuration string of the form `id:base64key,...` into an
+// encryptor. The first key is used for encryption. Returns nil if the string
+// is empty, which disables encryption.
+func parseEncryptionKeys(conf string) (*Encryptor, error) {
+	if conf == "" {
+		return nil, nil
+	}
+
+	var currentKeyID string
+	keys := make(map[string][]byte)
+	for _, pair := range strings.Split(conf, ",") {
+		i := strings.IndexRune(pair, ':')
+		if i < 0 {
+			return nil, fmt.Errorf("Bad encryption key pair: %s", pair)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(pair[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("Bad encryption key %s: %s", pair[0:i], err.Error())
+		}
+
+		if currentKeyID == "" {
+			currentKeyID = pair[0:i]
+		}
+		keys[pair[0:i]] = key
+	}
+
+	return NewEncryptor(keys, currentKeyID)
+}
+
+// Decrypts a blob stored under a key. Blobs that were stored without
+// encryption are returned as is.
+func (e *Encryptor) Decrypt(key string, blob []byte) ([]byte, error) {
+	if !bytes.HasPrefix(blob, encryptedMagic) {
+		return blob, nil
+	}
+
+	if e == nil {
+		return nil, fmt.Errorf("Blob at %s is encrypted, but no keys are configured", key)
+	}
+
+	header := blob[len(encryptedMagic):]
+	if len(header) < 1 || len(header) < 1+int(header[0]) {
+		return nil, fmt.Errorf("Blob at %s has a truncated header", key)
+	}
+
+	keyID := string(header[1 : 1+int(header[0])])
+	aead, ok := e.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("Blob at %s encrypted with unknown key: %s", key, keyID)
+	}
+
+	sealed := header[1+int(header[0]):]
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("Blob at %s is truncated", key)
+	}
+
+	return aead.Open(nil, sealed[0:aead.NonceSize()], sealed[aead.NonceSize():],
+		[]byte(key))
+}
+
+// Hides a search token or tag value that's about to become part of a Redis
+// key's name. Hashing is deterministic so that lookups can find the same
+// key. If encryption isn't enabled, the token is returned as is.
+func (e *Encryptor) IndexToken(token string) string {
+	if e == nil {
+		return token
+	}
+
+	mac := hmac.New(sha256.New, e.indexKey)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil)[0:16])
+}
+
+// Encrypts a blob to be stored under a key with the current key. If
+// encryption isn't enabled, the blob is returned as is.
+func (e *Encryptor) Encrypt(key string, blob []byte) ([]byte, error) {
+	if e == nil {
+		return blob, nil
+	}
+
+	aead := e.keys[e.currentKeyID]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	var buffer bytes.Buffer
+	buffer.Write(encryptedMagic)
+	buffer.WriteByte(byte(len(e.currentKeyID)))
+	buffer.WriteString(e.currentKeyID)
+	buffer.Write(nonce)
+	buffer.Write(aead.Seal(nil, nonce, blob, []byte(key)))
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestEncryptor(t *testing.T) {
+	key1 := bytes.Repeat([]byte("1"), 32)
+	key2 := bytes.Repeat([]byte("2"), 32)
+
+	old, err := NewEncryptor(map[string][]byte{"k1": key1}, "k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blob, err := old.Encrypt("lvat-request_id-req1", []byte("content"))
+	if err != nil {
+		t.Error(err)
+	}
+	if bytes.Contains(blob, []byte("content")) {
+		t.Errorf("Expected blob to be encrypted\n")
+	}
+
+	// rotate to a new key while keeping the old one for decryption
+	rotated, err := parseEncryptionKeys(
+		"k2:" + base64.StdEncoding.EncodeToString(key2) +
+			",k1:" + base64.StdEncoding.EncodeToString(key1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decrypted, err := rotated.Decrypt("lvat-request_id-req1", blob)
+	if err != nil {
+		t.Error(err)
+	}
+	if string(decrypted) != "content" {
+		t.Errorf("Expected decrypted %v, got %v\n", "content", string(decrypted))
+	}
+
+	blob, err = rotated.Encrypt("lvat-request_id-req1", []byte("content"))
+	if err != nil {
+		t.Error(err)
+	}
+	if _, err = old.Decrypt("lvat-request_id-req1", blob); err == nil {
+		t.Errorf("Expected error decrypting with a missing key\n")
+	}
+
+	// blobs can't be moved between keys
+	if _, err = rotated.Decrypt("lvat-request_id-req2", blob); err == nil {
+		t.Errorf("Expected error decrypting under a different key\n")
+	}
+
+	// unencrypted blobs are passed through
+	decrypted, err = rotated.Decrypt("lvat-request_id-req1", []byte("plain"))
+	if err != nil {
+		t.Error(err)
+	}
+	if string(decrypted) != "plain" {
+		t.Errorf("Expected decrypted %v, got %v\n", "plain", string(decrypted))
+	}
+
+	var disabled *Encryptor
+	blob, err = disabled.Encrypt("lvat-request_id-req1", []byte("content"))
+	if err != nil {
+		t.Error(err)
+	}
+	if string(blob) != "content" {
+		t.Errorf("Expected blob %v, got %v\n", "content", string(blob))
+	}
+}
+
+func TestParseEncryptionKeys(t *testing.T) {
+	encryptor, err := parseEncryptionKeys("")
+	if err != nil {
+		t.Error(err)
+	}
+	if encryptor != nil {
+		t.Errorf("Expected encryption to be disabled\n")
+	}
+
+	_, err = parseEncryptionKeys("k1:" + base64.StdEncoding.EncodeToString([]byte("short")))
+	if err == nil {
+		t.Errorf("Expected error for bad key size\n")
+	}
+
+	_, err = parseEncryptionKeys("k1")
+	if err == nil {
+		t.Errorf("Expected error for missing key\n")
+	}
+}
+
+func TestEncryptorIndexToken(t *testing.T) {
+	var disabled *Encryptor
+	if disabled.IndexToken("at=error") != "at=error" {
+		t.Errorf("Expected token to be unchanged without encryption\n")
+	}
+
+	encryptor, err := NewEncryptor(
+		map[string][]byte{"k1": bytes.Repeat([]byte("1"), 32)}, "k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := encryptor.IndexToken("at=error")
+	if strings.Contains(token, "error") {
+		t.Errorf("Expected token to be hashed, got %v\n", token)
+	}
+	if encryptor.IndexToken("at=error") != token {
+		t.Errorf("Expected token to hash the same way every time\n")
+	}
+	if encryptor.IndexToken("at=info") == token {
+		t.Errorf("Expected different tokens to hash differently\n")
+	}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	ExportNDJSON = "ndjson"
+	ExportTar    = "tar"
+
+	// PAX record carrying a key's remaining TTL in tar archives.
+	exportTTLRecord = "LVAT.ttl"
+)
+
+// ExportedKey is a stored key along with its decompressed lines and the
+// remaining TTL in seconds, or -1 if it doesn't expire. Lines are kept as
+// bytes (which JSON encodes as base64) because they aren't necessarily valid
+// UTF-8.
+type ExportedKey struct {
+	Index string   `json:"index"`
+	Lines [][]byte `json:"lines"`
+	TTL   int      `json:"ttl"`
+	Value string   `json:"value"`
+}
+
+type ExportOptions struct {
+	format string
+
+	// Only keys for this conf are exported if set.
+	index string
+
+	// Glob pattern that values must match. All values are exported if
+	// empty.
+	match string
+}
+
+// Streams every key stored for the retriever's confs (or the subset
+// selected by options) to an archive. Returns the number of keys exported.
+func exportTraces(retriever *Retriever, out io.Writer, options *ExportOptions) (int, error) {
+	conn := retriever.connPool.Get()
+	defer conn.Close()
+
+	var write func(*ExportedKey) error
+	var finish func() error
+	switch options.format {
+	case "", ExportNDJSON:
+		encoder := json.NewEncoder(out)
+		write = func(exported *ExportedKey) error {
+			return encoder.Encode(exported)
+		}
+		finish = func() error { return nil }
+	case ExportTar:
+		archive := tar.NewWriter(out)
+		write = func(exported *ExportedKey) error {
+			return writeTarKey(archive, exported)
+		}
+		finish = archive.Close
+	default:
+		return 0, fmt.Errorf("Unknown export format: %s", options.format)
+	}
+
+	match := options.match
+	if match == "" {
+		match = "*"
+	}
+
+	count := 0
+	for _, conf := range retriever.confs {
+		if options.index != "" && conf.key != options.index {
+			continue
+		}
+
+		prefix := buildKey(conf.key, "")
+		cursor := 0
+		for {
+			values, err := redis.Values(conn.Do("SCAN", cursor,
+				"MATCH", buildKey(conf.key, match), "COUNT", 100))
+			if err != nil {
+				return count, err
+			}
+
+			cursor, _ = redis.Int(values[0], nil)
+			keys, _ := redis.Strings(values[1], nil)
+			for _, key := range keys {
+				exported, ok, err := exportKey(retriever, conn, conf, key)
+				if err != nil {
+					return count, fmt.Errorf("Couldn't export %s: %s", key, err.Error())
+				}
+
+				// expired between the scan and the lookup
+				if !ok {
+					continue
+				}
+
+				exported.Value = strings.TrimPrefix(key, prefix)
+				if err := write(exported); err != nil {
+					return count, err
+				}
+				count++
+			}
+
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+
+	return count, finish()
+}
+
+func exportKey(retriever *Retriever, conn redis.Conn, conf *IndexConf,
+	key string) (*ExportedKey, bool, error) {
+
+	blob, ok, err := retriever.lookupKey(conn, key)
+	if err != nil || !ok {
+		return nil, ok, err
+	}
+
+	ttl, err := redis.Int(conn.Do("TTL", key))
+	if err != nil {
+		return nil, false, err
+	}
+
+	// -2 means that the key is gone
+	if ttl == -2 {
+		return nil, false, nil
+	}
+
+	lines, err := readLines(blob)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &ExportedKey{Index: conf.key, Lines: lines, TTL: ttl}, true, nil
+}
+
+// Writes a key to a tar archive as `<index>/<value>.log`, one line per line.
+// The index and value are path escaped so that a `/` in either can't add a
+// directory.
+func writeTarKey(archive *tar.Writer, exported *ExportedKey) error {
+	var data bytes.Buffer
+	for _, line := range exported.Lines {
+		data.Write(line)
+		data.WriteString("\n")
+	}
+
+	err := archive.WriteHeader(&tar.Header{
+		Format:     tar.FormatPAX,
+		ModTime:    time.Now(),
+		Mode:       0644,
+		Name:       path.Join(url.PathEscape(exported.Index), url.PathEscape(exported.Value)+".log"),
+		PAXRecords: map[string]string{exportTTLRecord: strconv.Itoa(exported.TTL)},
+		Size:       int64(data.Len()),
+		Typeflag:   tar.TypeReg,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = archive.Write(data.Bytes())
+	return err
+}
+
+type RestoreOptions struct {
+	// Replaces keys that already exist instead of leaving them alone.
+	overwrite bool
+}
+
+type RestoreReport struct {
+	Expired  int
+	Existing int
+	Restored int
+	Unknown  int
+}
+
+// Loads an archive written by exportTraces back into Redis, detecting whether
+// it's NDJSON or tar. Keys are compressed with their conf's current codec and
+// get the TTL that they had remaining when they were exported.
+func restoreTraces(receiver *Receiver, input io.Reader, options *RestoreOptions,
+	report *RestoreReport) error {
+
+	reader := bufio.NewReader(input)
+
+	restore := func(exported *ExportedKey) error {
+		var conf *IndexConf
+		for _, c := range receiver.confs {
+			if c.key == exported.Index {
+				conf = c
+				break
+			}
+		}
+
+		if conf == nil {
+			report.Unknown++
+			return nil
+		}
+
+		if exported.TTL == 0 || exported.TTL < -1 {
+			report.Expired++
+			return nil
+		}
+
+		restored, err := receiver.restoreKey(conf, exported, options.overwrite)
+		if err != nil {
+			return fmt.Errorf("Couldn't restore %s: %s",
+				buildKey(exported.Index, exported.Value), err.Error())
+		}
+
+		if restored {
+			report.Restored++
+		} else {
+			report.Existing++
+		}
+		return nil
+	}
+
+	peeked, _ := reader.Peek(1)
+	if len(peeked) == 0 {
+		return nil
+	}
+
+	if peeked[0] == '{' {
+		decoder := json.NewDecoder(reader)
+		for {
+			exported := &ExportedKey{}
+			err := decoder.Decode(exported)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			if err := restore(exported); err != nil {
+				return err
+			}
+		}
+	}
+
+	archive := tar.NewReader(reader)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		data, err := ioutil.ReadAll(archive)
+		if err != nil {
+			return err
+		}
+
+		exported, err := readTarKey(header.Name, data)
+		if err != nil {
+			return err
+		}
+		if ttl, ok := header.PAXRecords[exportTTLRecord]; ok {
+			exported.TTL, _ = strconv.Atoi(ttl)
+		}
+
+		if err := restore(exported); err != nil {
+			return err
+		}
+	}
+}
+
+// Reads a key back from a tar archive member written by writeTarKey. An
+// empty member has no lines.
+func readTarKey(name string, data []byte) (*ExportedKey, error) {
+	dir, file := path.Split(name)
+
+	index, err := url.PathUnescape(strings.TrimSuffix(dir, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("Bad archive path %s: %s", name, err.Error())
+	}
+
+	value, err := url.PathUnescape(strings.TrimSuffix(file, ".log"))
+	if err != nil {
+		return nil, fmt.Errorf("Bad archive path %s: %s", name, err.Error())
+	}
+
+	exported := &ExportedKey{Index: index, TTL: -1, Value: value}
+	if len(data) > 0 {
+		exported.Lines = bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n"))
+	}
+	return exported, nil
+}
+
+// Writes an exported key and rebuilds its entries in the secondary indexes.
+// Returns false if the key already existed and wasn't overwritten.
+func (r *Receiver) restoreKey(conf *IndexConf, exported *ExportedKey,
+	overwrite bool) (bool, error) {
+
+	lines := exported.Lines
+	var data bytes.Buffer
+	for _, line := range lines {
+		data.Write(line)
+		data.WriteString("\n")
+	}
+
+	key := buildKey(conf.key, exported.Value)
+
+	codec := confCodec(conf)
+	compressed, err := codec.Compress(data.Bytes())
+	if err != nil {
+		return false, err
+	}
+
+	blob, err := r.encryptor.Encrypt(key, encodeBlob(&Blob{Codec: codec, Data: compressed}))
+	if err != nil {
+		return false, err
+	}
+
+	args := []interface{}{key, blob}
+	if exported.TTL > 0 {
+		args = append(args, "EX", exported.TTL)
+	}
+	if !overwrite {
+		args = append(args, "NX")
+	}
+
+	conn := r.connPool.Get()
+	res, err := conn.Do("SET", args...)
+	conn.Close()
+	if err != nil {
+		return false, err
+	}
+
+	// NX returns nil if the key was already set
+	if res == nil {
+		return false, nil
+	}
+
+	if err := r.recordRecent(conf, exported.Value, lines); err != nil {
+		return true, err
+	}
+	return true, r.recordSearch(conf, exported.Value, lines)
+}
+
+// Exports stored traces to stdout or a file.
+func exportCommand(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := flags.String("format", ExportNDJSON, "archive format: ndjson or tar")
+	index := flags.String("index", "", "only export keys for this index")
+	match := flags.String("match", "", "only export values matching this glob pattern")
+	output := flags.String("o", "-", "path to write the archive to (- for stdout)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	pool, err := commandPool()
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	exporter := NewRetriever(confs, pool)
+	exporter.encryptor = encryptor
+
+	out := os.Stdout
+	if *output != "-" {
+		out, err = os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+
+	writer := bufio.NewWriter(out)
+	count, err := exportTraces(exporter, writer, &ExportOptions{
+		format: *format,
+		index:  *index,
+		match:  *match,
+	})
+	if err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "export keys=%v\n", count)
+	return nil
+}
+
+// Restores stored traces from archive files or stdin.
+func restoreCommand(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	overwrite := flags.Bool("overwrite", false, "replace keys that already exist")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	pool, err := commandPool()
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	restorer := NewReceiver(confs, pool)
+	restorer.encryptor = encryptor
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{"-"}
+	}
+
+	options := &RestoreOptions{overwrite: *overwrite}
+	report := &RestoreReport{}
+	for _, path := range paths {
+		var err error
+		if path == "-" {
+			err = restoreTraces(restorer, os.Stdin, options, report)
+		} else {
+			var file *os.File
+			file, err = os.Open(path)
+			if err != nil {
+				return err
+			}
+			err = restoreTraces(restorer, file, options, report)
+			file.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("Couldn't restore %s: %s", path, err.Error())
+		}
+	}
+
+	fmt.Printf("restore restored=%v existing=%v expired=%v unknown=%v\n",
+		report.Restored, report.Existing, report.Expired, report.Unknown)
+	return nil
+}
+
+// Configures storage from the environment and connects to Redis for a
+// command that runs outside of the server.
+func commandPool() (*redis.Pool, error) {
+	if err := configure(); err != nil {
+		return nil, err
+	}
+
+	redisUrl := os.Getenv("REDIS_URL")
+	if redisUrl == "" {
+		return nil, fmt.Errorf("Need REDIS_URL")
+	}
+
+	return newRedisPool(redisUrl, redisOptions), nil
+}
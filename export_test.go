@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestExportRestore(t *testing.T) {
+	for _, format := range []string{ExportNDJSON, ExportTar} {
+		setup(t)
+
+		receiver := NewReceiver([]*IndexConf{conf}, connPool)
+		retriever := NewRetriever([]*IndexConf{conf}, connPool)
+
+		_, err := receiver.compress(conf, "req1", [][]byte{
+			[]byte("request_id=req1 n=1"),
+			[]byte("request_id=req1 n=2"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// values can contain slashes and lines needn't be valid UTF-8
+		_, err = receiver.compress(conf, "req/2", [][]byte{[]byte("request_id=req/2 \xff")})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn := connPool.Get()
+		_, err = conn.Do("EXPIRE", buildKey(conf.key, "req1"), 600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var archive bytes.Buffer
+		count, err := exportTraces(retriever, &archive, &ExportOptions{format: format})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 2 {
+			t.Errorf("Expected %v keys exported as %v, got %v\n", 2, format, count)
+		}
+
+		_, err = conn.Do("FLUSHALL")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		report := &RestoreReport{}
+		err = restoreTraces(receiver, bytes.NewReader(archive.Bytes()), &RestoreOptions{}, report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Restored != 2 {
+			t.Errorf("Expected %v keys restored from %v, got %v\n", 2, format, report.Restored)
+		}
+
+		blob, ok, err := retriever.Lookup("req1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatalf("Expected found true, got false\n")
+		}
+
+		lines, err := readLines(blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(lines) != 2 || string(lines[1]) != "request_id=req1 n=2" {
+			t.Errorf("Expected restored lines, got %q\n", lines)
+		}
+
+		blob, ok, err = retriever.Lookup("req/2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatalf("Expected found true for req/2 from %v, got false\n", format)
+		}
+
+		lines, err = readLines(blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(lines) != 1 || string(lines[0]) != "request_id=req/2 \xff" {
+			t.Errorf("Expected restored bytes from %v, got %q\n", format, lines)
+		}
+
+		ttl, err := redis.Int(conn.Do("TTL", buildKey(conf.key, "req1")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ttl <= 0 || ttl > 600 {
+			t.Errorf("Expected TTL of at most %v, got %v\n", 600, ttl)
+		}
+
+		// keys that already exist are left alone unless overwriting
+		report = &RestoreReport{}
+		err = restoreTraces(receiver, bytes.NewReader(archive.Bytes()), &RestoreOptions{}, report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Existing != 2 {
+			t.Errorf("Expected %v existing keys, got %v\n", 2, report.Existing)
+		}
+
+		conn.Close()
+	}
+}
+
+func TestReadTarKey(t *testing.T) {
+	exported, err := readTarKey("request_id/req%2F1.log", []byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exported.Index != "request_id" || exported.Value != "req/1" {
+		t.Errorf("Expected key %v, got %v\n", "request_id/req/1",
+			exported.Index+"/"+exported.Value)
+	}
+	if len(exported.Lines) != 0 {
+		t.Errorf("Expected no lines for an empty member, got %q\n", exported.Lines)
+	}
+
+	exported, err = readTarKey("request_id/req1.log", []byte("a\n\nb\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exported.Lines) != 3 || len(exported.Lines[1]) != 0 {
+		t.Errorf("Expected %v lines, got %q\n", 3, exported.Lines)
+	}
+
+	_, err = readTarKey("request_id/req%zz.log", []byte{})
+	if err == nil {
+		t.Errorf("Expected an error for a badly escaped path\n")
+	}
+}
+
+func TestExportFilter(t *testing.T) {
+	setup(t)
+
+	receiver := NewReceiver([]*IndexConf{conf}, connPool)
+	retriever := NewRetriever([]*IndexConf{conf}, connPool)
+
+	for _, value := range []string{"req1", "req2", "other"} {
+		_, err := receiver.compress(conf, value, [][]byte{[]byte("request_id=" + value)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var archive bytes.Buffer
+	count, err := exportTraces(retriever, &archive, &ExportOptions{match: "req*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("Expected %v keys exported, got %v\n", 2, count)
+	}
+
+	count, err = exportTraces(retriever, &archive, &ExportOptions{index: "user_id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("Expected %v keys exported, got %v\n", 0, count)
+	}
+}
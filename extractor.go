@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Extractor derives an index value directly from a message's data. It's
+// used for lines that don't parse cleanly into pairs, like router output or
+// third-party buildpack logs.
+type Extractor interface {
+	Extract(data []byte) (string, bool)
+}
+
+// JSONPathExtractor pulls a value out of a JSON message using a dotted path
+// like `request.id`, as produced by the JSON parser's flattening.
+type JSONPathExtractor struct {
+	path string
+}
+
+func NewJSONPathExtractor(path string) *JSONPathExtractor {
+	return &JSONPathExtractor{path: path}
+}
+
+func (e *JSONPathExtractor) Extract(data []byte) (string, bool) {
+	// extractors only run on messages whose pairs didn't have the value,
+	// so don't bother decoding anything that can't be an object
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || data[0] != '{' {
+		return "", false
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var object map[string]interface{}
+	if err := decoder.Decode(&object); err != nil {
+		return "", false
+	}
+
+	pairs := make(map[string]string)
+	flattenJSON(pairs, "", object)
+
+	value, ok := pairs[e.path]
+	if !ok || value == "" {
+		return "", false
+	}
+	return value, true
+}
+
+// Sets JSON path extractors for indexes from a configuration string like
+// `request_id=request.id,user_id=user.id`, replacing any extractor that an
+// index already had.
+func parseJSONPaths(conf string, confs []*IndexConf) error {
+	if conf == "" {
+		return nil
+	}
+
+	for _, pair := range strings.Split(conf, ",") {
+		i := strings.IndexRune(pair, '=')
+		if i < 0 || i == len(pair)-1 {
+			return fmt.Errorf("Bad JSON path pair: %s", pair)
+		}
+
+		var found *IndexConf
+		for _, c := range confs {
+			if c.key == pair[0:i] {
+				found = c
+			}
+		}
+		if found == nil {
+			return fmt.Errorf("Unknown index: %s", pair[0:i])
+		}
+
+		found.extractor = NewJSONPathExtractor(pair[i+1:])
+	}
+
+	return nil
+}
+
+// RegexExtractor matches a message against a regex and uses the contents of
+// one of its named capture groups as the value.
+type RegexExtractor struct {
+	group   int
+	pattern *regexp.Regexp
+}
+
+// Builds a new regex extractor using the capture group named by `name`. If
+// the pattern doesn't contain a group with that name, the extractor will
+// never produce a value.
+func NewRegexExtractor(pattern *regexp.Regexp, name string) *RegexExtractor {
+	group := -1
+	for i, subexpName := range pattern.SubexpNames() {
+		if subexpName == name {
+			group = i
+			break
+		}
+	}
+
+	return &RegexExtractor{
+		group:   group,
+		pattern: pattern,
+	}
+}
+
+func (e *RegexExtractor) Extract(data []byte) (string, bool) {
+	if e.group < 0 {
+		return "", false
+	}
+
+	matches := e.pattern.FindSubmatch(data)
+	if matches == nil || len(matches[e.group]) == 0 {
+		return "", false
+	}
+	return string(matches[e.group]), true
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestJSONPathExtractor(t *testing.T) {
+	extractor := NewJSONPathExtractor("request.id")
+
+	value, ok := extractor.Extract([]byte(`{"request":{"id":"req1"}}`))
+	if !ok {
+		t.Errorf("Expected found true, got false\n")
+	}
+	if value != "req1" {
+		t.Errorf("Expected value %v, got %v\n", "req1", value)
+	}
+
+	_, ok = extractor.Extract([]byte(`request_id=req1`))
+	if ok {
+		t.Errorf("Expected found false, got true\n")
+	}
+}
+
+func TestParseJSONPaths(t *testing.T) {
+	pathConf := &IndexConf{key: "request_id"}
+
+	err := parseJSONPaths("request_id=request.id", []*IndexConf{pathConf})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, ok := indexValue(pathConf, &LogMessage{
+		data:  []byte(`{"request":{"id":"req1"}}`),
+		pairs: map[string]string{},
+	})
+	if !ok || value != "req1" {
+		t.Errorf("Expected value %v, got %v\n", "req1", value)
+	}
+
+	for _, bad := range []string{"request_id", "request_id=", "user_id=user.id"} {
+		if err := parseJSONPaths(bad, []*IndexConf{pathConf}); err == nil {
+			t.Errorf("Expected an error for %q\n", bad)
+		}
+	}
+}
+
+func TestRegexExtractor(t *testing.T) {
+	extractor := NewRegexExtractor(
+		regexp.MustCompile(`request-id: (?P<value>\w+)`), "value")
+
+	value, ok := extractor.Extract([]byte("GET /apps request-id: abc123 took 12ms"))
+	if !ok {
+		t.Errorf("Expected found true, got false\n")
+	}
+	if value != "abc123" {
+		t.Errorf("Expected value %v, got %v\n", "abc123", value)
+	}
+
+	_, ok = extractor.Extract([]byte("GET /apps took 12ms"))
+	if ok {
+		t.Errorf("Expected found false, got true\n")
+	}
+
+	extractor = NewRegexExtractor(
+		regexp.MustCompile(`request-id: (?P<value>\w+)`), "other")
+	_, ok = extractor.Extract([]byte("GET /apps request-id: abc123 took 12ms"))
+	if ok {
+		t.Errorf("Expected found false for missing group, got true\n")
+	}
+}
+
+func TestDefaultExtractor(t *testing.T) {
+	extractor := confs[0].extractor
+
+	value, ok := extractor.Extract([]byte(`at=info request-id: "req1,req2"`))
+	if !ok {
+		t.Errorf("Expected found true, got false\n")
+	}
+	if value != "req1,req2" {
+		t.Errorf("Expected value %v, got %v\n", "req1,req2", value)
+	}
+
+	value, ok = extractor.Extract([]byte("request_id=req1"))
+	if !ok || value != "req1" {
+		t.Errorf("Expected value %v at the start of the line, got %v\n", "req1", value)
+	}
+
+	// a parent's ID isn't the line's own
+	_, ok = extractor.Extract([]byte("at=info parent_request_id=req1"))
+	if ok {
+		t.Errorf("Expected found false for parent_request_id, got true\n")
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// Fraction of MessagesChan's capacity past which the receiver is
+	// considered saturated and the dyno shouldn't receive more traffic.
+	ReadyQueueThreshold = 0.9
+
+	// How long Redis has to answer a PING.
+	ReadyRedisTimeout = 1 * time.Second
+)
+
+type HealthCheck struct {
+	Detail map[string]interface{} `json:"detail,omitempty"`
+	Error  string                 `json:"error,omitempty"`
+	OK     bool                   `json:"ok"`
+}
+
+// Checks whether a dyno is fit to receive traffic: Redis must be reachable
+// through the pool, stores can't be failing fast, the receiver's queue can't
+// be saturated, and all of its workers must be running.
+func checkReadiness(receiver *Receiver, connPool *redis.Pool,
+	timeout time.Duration) (bool, map[string]*HealthCheck) {
+
+	checks := map[string]*HealthCheck{
+		"circuit": checkCircuit(receiver),
+		"queue":   checkQueue(receiver),
+		"redis":   checkRedis(connPool, timeout),
+		"workers": checkWorkers(receiver),
+	}
+
+	ready := true
+	for _, check := range checks {
+		ready = ready && check.OK
+	}
+	return ready, checks
+}
+
+func checkCircuit(receiver *Receiver) *HealthCheck {
+	check := &HealthCheck{OK: !receiver.breaker.Open()}
+	if !check.OK {
+		check.Error = "Circuit breaker is open"
+	}
+	return check
+}
+
+func checkQueue(receiver *Receiver) *HealthCheck {
+	size := len(receiver.MessagesChan)
+	capacity := cap(receiver.MessagesChan)
+
+	check := &HealthCheck{
+		Detail: map[string]interface{}{"capacity": capacity, "size": size},
+		OK:     float64(size) < float64(capacity)*ReadyQueueThreshold,
+	}
+	if !check.OK {
+		check.Error = "Message queue is saturated"
+	}
+	return check
+}
+
+// PINGs Redis with a connection from the pool. The PING happens in the
+// background so that a hung connection can't hold up the check.
+func checkRedis(connPool *redis.Pool, timeout time.Duration) *HealthCheck {
+	start := time.Now()
+
+	result := make(chan error, 1)
+	go func() {
+		conn := connPool.Get()
+		defer conn.Close()
+
+		_, err := conn.Do("PING")
+		result <- err
+	}()
+
+	var err error
+	select {
+	case err = <-result:
+	case <-time.After(timeout):
+		err = fmt.Errorf("Timed out after %v", timeout)
+	}
+
+	check := &HealthCheck{
+		Detail: map[string]interface{}{
+			"latency_ms": time.Since(start).Seconds() * 1000,
+		},
+		OK: err == nil,
+	}
+	if err != nil {
+		check.Error = err.Error()
+	}
+	return check
+}
+
+func checkWorkers(receiver *Receiver) *HealthCheck {
+	alive := receiver.Workers()
+	expected := len(receiver.shards)
+
+	check := &HealthCheck{
+		Detail: map[string]interface{}{"alive": alive, "expected": expected},
+		OK:     expected > 0 && alive >= expected,
+	}
+	if !check.OK {
+		check.Error = "Not all workers are running"
+	}
+	return check
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestReadiness(t *testing.T) {
+	setup(t)
+
+	receiver = NewReceiver([]*IndexConf{conf}, connPool)
+
+	// no workers yet
+	ready, checks := checkReadiness(receiver, connPool, ReadyRedisTimeout)
+	if ready {
+		t.Errorf("Expected ready false, got true\n")
+	}
+	if checks["workers"].OK {
+		t.Errorf("Expected workers check to fail\n")
+	}
+	if !checks["redis"].OK {
+		t.Errorf("Expected redis check to pass, got %v\n", checks["redis"].Error)
+	}
+
+	receiver.Run()
+	defer close(receiver.MessagesChan)
+	for i := 0; i < 100 && receiver.Workers() < Concurrency; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	w := httptest.NewRecorder()
+	readyz(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != 200 {
+		t.Errorf("Expected code 200, got %v: %v\n", w.Code, w.Body.String())
+	}
+
+	var body struct {
+		Checks map[string]*HealthCheck `json:"checks"`
+		Status string                  `json:"status"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Status != "ok" || len(body.Checks) != 4 {
+		t.Errorf("Expected status ok with 4 checks, got %v %v\n", body.Status, body.Checks)
+	}
+}
+
+func TestReadinessRedisDown(t *testing.T) {
+	pool := redis.NewPool(redisConnect("redis://localhost:1", nil), 1)
+	defer pool.Close()
+
+	check := checkRedis(pool, ReadyRedisTimeout)
+	if check.OK {
+		t.Errorf("Expected redis check to fail\n")
+	}
+	if check.Error == "" {
+		t.Errorf("Expected an error\n")
+	}
+}
+
+func TestReadinessQueueSaturated(t *testing.T) {
+	saturated := NewReceiver([]*IndexConf{conf}, connPool)
+	for i := 0; i < cap(saturated.MessagesChan); i++ {
+		saturated.MessagesChan <- nil
+	}
+
+	check := checkQueue(saturated)
+	if check.OK {
+		t.Errorf("Expected queue check to fail\n")
+	}
+}
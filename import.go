@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/bmizerany/lpx"
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	ImportDefaultBatch = 500
+
+	ImportLogplex = "logplex"
+	ImportNDJSON  = "ndjson"
+	ImportSyslog  = "syslog"
+)
+
+var (
+	// Matches the header of an RFC 5424 syslog line up to its message.
+	// Structured data is optional because Logplex leaves it out.
+	syslogHeaderPattern = regexp.MustCompile(
+		`^<\d+>\d+ \S+ \S+ \S+ \S+ \S+ (?:(?:-|(?:\[[^\]]*\])+) )?`)
+
+	// Matches the octet count and priority that start a Logplex frame.
+	logplexFramePattern = regexp.MustCompile(`^\d+ <\d+>`)
+)
+
+type ImportOptions struct {
+	batchSize int
+	dryRun    bool
+
+	// One of the Import* formats, or empty to detect the format from the
+	// start of the input.
+	format string
+
+	// Where dry runs report the keys that would be written.
+	out io.Writer
+
+	// Used to parse the messages of Logplex and syslog input.
+	parser Parser
+
+	// Maximum number of lines to import each second. Unlimited if zero.
+	rate int
+}
+
+type ImportReport struct {
+	Failed   int
+	Groups   int
+	Messages int
+	Skipped  int
+
+	// Groups that weren't written because they were sampled out or went
+	// over their rate limit.
+	Dropped int
+}
+
+// Guesses the format of an import from its first bytes: Logplex frames start
+// with their length, NDJSON with an object, and anything else is treated as
+// plain syslog lines.
+func detectImportFormat(reader *bufio.Reader) string {
+	peeked, _ := reader.Peek(64)
+	peeked = bytes.TrimLeft(peeked, " \t\r\n")
+
+	switch {
+	case len(peeked) == 0:
+		return ImportSyslog
+	case peeked[0] == '{':
+		return ImportNDJSON
+	case logplexFramePattern.Match(peeked):
+		return ImportLogplex
+	}
+	return ImportSyslog
+}
+
+// Strips the header from a syslog line, leaving only its message. Lines
+// without a recognizable header are left as they are.
+func syslogMessage(line []byte) []byte {
+	if loc := syslogHeaderPattern.FindIndex(line); loc != nil {
+		return line[loc[1]:]
+	}
+	return line
+}
+
+// Reads messages from a log dump and runs them through the same grouping and
+// storage pipeline as messages received from a drain, in batches.
+func importLogs(receiver *Receiver, input io.Reader, options *ImportOptions,
+	report *ImportReport) error {
+
+	reader := bufio.NewReader(input)
+
+	format := options.format
+	if format == "" {
+		format = detectImportFormat(reader)
+	}
+
+	parser := options.parser
+	if parser == nil {
+		parser = parsers["auto"]
+	}
+
+	var next func() ([]byte, bool)
+	var readErr func() error
+	switch format {
+	case ImportLogplex:
+		lp := lpx.NewReader(reader)
+		next = func() ([]byte, bool) {
+			if !lp.Next() {
+				return nil, false
+			}
+			return bytes.TrimSpace(lp.Bytes()), true
+		}
+		readErr = lp.Err
+	case ImportNDJSON, ImportSyslog:
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		next = func() ([]byte, bool) {
+			if !scanner.Scan() {
+				return nil, false
+			}
+
+			line := bytes.TrimSpace(scanner.Bytes())
+			if format == ImportSyslog {
+				line = syslogMessage(line)
+			}
+			return line, true
+		}
+		readErr = scanner.Err
+		if format == ImportNDJSON {
+			parser = parsers["json"]
+		}
+	default:
+		return fmt.Errorf("Unknown import format: %s", format)
+	}
+
+	batchSize := options.batchSize
+	if batchSize <= 0 {
+		batchSize = ImportDefaultBatch
+	}
+
+	batch := make([]*LogMessage, 0, batchSize)
+	for {
+		data, ok := next()
+		if ok && len(data) > 0 {
+			message := &LogMessage{
+				data:  append([]byte(nil), data...),
+				pairs: make(map[string]string),
+			}
+			if err := parser.Parse(message); err != nil {
+				printVerbose("skip_message err=%q\n", err.Error())
+				report.Skipped++
+			} else {
+				batch = append(batch, message)
+			}
+		}
+
+		if len(batch) > 0 && (len(batch) >= batchSize || !ok) {
+			importBatch(receiver, batch, options, report)
+			batch = batch[:0]
+		}
+
+		if !ok {
+			break
+		}
+	}
+
+	return readErr()
+}
+
+func importBatch(receiver *Receiver, batch []*LogMessage, options *ImportOptions,
+	report *ImportReport) {
+
+	start := time.Now()
+	report.Messages += len(batch)
+
+	receiver.redact(batch)
+	for conf, confGroups := range receiver.buildGroups(batch) {
+		report.Groups += len(confGroups)
+
+		for value, lines := range confGroups {
+			// without a Redis pool during a dry run, sampling decisions
+			// are only shared within the import
+			if !receiver.shouldStore(conf, value, lines) {
+				report.Dropped++
+				continue
+			}
+
+			if options.dryRun {
+				fmt.Fprintf(options.out, "would_write key=%v value=%v lines=%v\n",
+					conf.key, value, len(lines))
+			} else if !receiver.storeGroup(conf, value, lines) {
+				report.Failed++
+			}
+		}
+	}
+
+	// pace batches so that the import doesn't overwhelm Redis
+	if options.rate > 0 {
+		minimum := time.Duration(len(batch)) * time.Second / time.Duration(options.rate)
+		if elapsed := time.Since(start); elapsed < minimum {
+			time.Sleep(minimum - elapsed)
+		}
+	}
+}
+
+// Imports log files (or stdin) into the index. Configuration comes from the
+// same environment as serving.
+func importCommand(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	batchSize := flags.Int("batch", ImportDefaultBatch, "number of messages to group and store at once")
+	dryRun := flags.Bool("dry-run", false, "report the keys that would be written without writing them")
+	format := flags.String("format", "", "input format: logplex, ndjson, or syslog (detected if empty)")
+	parserName := flags.String("parser", "", "parser for Logplex and syslog messages (defaults to PARSER)")
+	rate := flags.Int("rate", 0, "maximum number of messages to import per second (0 for unlimited)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if err := configure(); err != nil {
+		return err
+	}
+
+	parser := defaultParser
+	if *parserName != "" {
+		var err error
+		parser, err = findParser(*parserName)
+		if err != nil {
+			return err
+		}
+	}
+
+	var pool *redis.Pool
+	if !*dryRun {
+		redisUrl := os.Getenv("REDIS_URL")
+		if redisUrl == "" {
+			return fmt.Errorf("Need REDIS_URL")
+		}
+
+		pool = newRedisPool(redisUrl, redisOptions)
+		defer pool.Close()
+	}
+
+	redactor, err := configuredRedactor()
+	if err != nil {
+		return err
+	}
+
+	importer := NewReceiver(confs, pool)
+	importer.redactor = redactor
+	importer.encryptor = encryptor
+
+	options := &ImportOptions{
+		batchSize: *batchSize,
+		dryRun:    *dryRun,
+		format:    *format,
+		out:       os.Stdout,
+		parser:    parser,
+		rate:      *rate,
+	}
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{"-"}
+	}
+
+	report := &ImportReport{}
+	for _, path := range paths {
+		var err error
+		if path == "-" {
+			err = importLogs(importer, os.Stdin, options, report)
+		} else {
+			var file *os.File
+			file, err = os.Open(path)
+			if err != nil {
+				return err
+			}
+			err = importLogs(importer, file, options, report)
+			file.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("Couldn't import %s: %s", path, err.Error())
+		}
+	}
+
+	fmt.Printf("import messages=%v skipped=%v groups=%v dropped=%v failed=%v dry_run=%v\n",
+		report.Messages, report.Skipped, report.Groups, report.Dropped, report.Failed, *dryRun)
+
+	if report.Failed > 0 {
+		return fmt.Errorf("Failed to write %v groups", report.Failed)
+	}
+	return nil
+}
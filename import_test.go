@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDetectImportFormat(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected string
+	}{
+		{"", ImportSyslog},
+		{"{\"request_id\":\"req1\"}\n", ImportNDJSON},
+		{"  {\"request_id\":\"req1\"}\n", ImportNDJSON},
+		{"83 <40>1 2012-11-30T06:45:29+00:00 host app web.3 - request_id=req1", ImportLogplex},
+		{"<40>1 2012-11-30T06:45:29+00:00 host app web.3 - request_id=req1\n", ImportSyslog},
+		{"request_id=req1\n", ImportSyslog},
+		{"2012-11-30T06:45:29+00:00 request_id=req1\n", ImportSyslog},
+		{"200 OK request_id=req1\n", ImportSyslog},
+	}
+
+	for _, c := range cases {
+		actual := detectImportFormat(bufio.NewReader(strings.NewReader(c.input)))
+		if actual != c.expected {
+			t.Errorf("Expected %q to be detected as %v, got %v\n",
+				c.input, c.expected, actual)
+		}
+	}
+}
+
+func TestSyslogMessage(t *testing.T) {
+	cases := []struct {
+		line     string
+		expected string
+	}{
+		{"<40>1 2012-11-30T06:45:29+00:00 host app web.3 - request_id=req1", "request_id=req1"},
+		{"<40>1 2012-11-30T06:45:29+00:00 host app web.3 - [meta a=\"b\"] request_id=req1", "request_id=req1"},
+		{"<40>1 2012-11-30T06:45:29+00:00 host app web.3 - - request_id=req1", "request_id=req1"},
+		{"request_id=req1", "request_id=req1"},
+	}
+
+	for _, c := range cases {
+		actual := string(syslogMessage([]byte(c.line)))
+		if actual != c.expected {
+			t.Errorf("Expected message %q, got %q\n", c.expected, actual)
+		}
+	}
+}
+
+func TestImportLogs(t *testing.T) {
+	setup(t)
+
+	receiver := NewReceiver([]*IndexConf{conf}, connPool)
+	retriever := NewRetriever([]*IndexConf{conf}, connPool)
+
+	inputs := []string{
+		"<40>1 2012-11-30T06:45:29+00:00 host app web.3 - request_id=req1 n=1\n" +
+			"<40>1 2012-11-30T06:45:29+00:00 host app web.3 - request_id=req1 n=2\n" +
+			"no identifier here\n",
+		"{\"request_id\":\"req2\"}\nnot json\n",
+		"64 <40>1 2012-11-30T06:45:29+00:00 host app web.3 - request_id=req3\n",
+	}
+
+	report := &ImportReport{}
+	for _, input := range inputs {
+		err := importLogs(receiver, strings.NewReader(input),
+			&ImportOptions{batchSize: 2}, report)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if report.Messages != 5 {
+		t.Errorf("Expected %v messages, got %v\n", 5, report.Messages)
+	}
+	if report.Skipped != 1 {
+		t.Errorf("Expected %v skipped, got %v\n", 1, report.Skipped)
+	}
+
+	for value, expected := range map[string]int{"req1": 2, "req2": 1, "req3": 1} {
+		blob, ok, err := retriever.Lookup(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatalf("Expected %v to be imported\n", value)
+		}
+
+		lines, err := readLines(blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(lines) != expected {
+			t.Errorf("Expected %v lines for %v, got %v\n", expected, value, len(lines))
+		}
+	}
+}
+
+func TestImportLogsDryRun(t *testing.T) {
+	setup(t)
+
+	receiver := NewReceiver([]*IndexConf{conf}, connPool)
+	retriever := NewRetriever([]*IndexConf{conf}, connPool)
+
+	var out bytes.Buffer
+	report := &ImportReport{}
+	err := importLogs(receiver, strings.NewReader("request_id=req1\nrequest_id=req1\n"),
+		&ImportOptions{dryRun: true, out: &out}, report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "would_write key=request_id value=req1 lines=2\n"
+	if out.String() != expected {
+		t.Errorf("Expected output %q, got %q\n", expected, out.String())
+	}
+	if report.Groups != 1 {
+		t.Errorf("Expected %v groups, got %v\n", 1, report.Groups)
+	}
+
+	_, ok, err := retriever.Lookup("req1")
+	if err != nil {
+		t.Error(err)
+	}
+	if ok {
+		t.Errorf("Expected dry run not to write\n")
+	}
+}
+
+func TestImportLogsDryRunSampling(t *testing.T) {
+	sampleConf := &IndexConf{
+		alwaysKeep: parsePredicates("at=error"),
+		key:        "request_id",
+		maxSize:    2,
+		sampleRate: 0.0001,
+		ttl:        1 * time.Hour,
+	}
+
+	// a dry run has no Redis pool to record sampling decisions in
+	receiver := NewReceiver([]*IndexConf{sampleConf}, nil)
+
+	var out bytes.Buffer
+	report := &ImportReport{}
+	err := importLogs(receiver, strings.NewReader(
+		"request_id=req1 at=info\nrequest_id=req1 at=error\nrequest_id=req1 at=info\n"),
+		&ImportOptions{batchSize: 1, dryRun: true, out: &out}, report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Groups != 3 {
+		t.Errorf("Expected %v groups, got %v\n", 3, report.Groups)
+	}
+	if report.Dropped != 1 {
+		t.Errorf("Expected %v dropped, got %v\n", 1, report.Dropped)
+	}
+
+	expected := "would_write key=request_id value=req1 lines=1\n" +
+		"would_write key=request_id value=req1 lines=1\n"
+	if out.String() != expected {
+		t.Errorf("Expected output %q, got %q\n", expected, out.String())
+	}
+}
@@ -3,36 +3,99 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"compress/gzip"
+	"encoding/json"
 	"fmt"
 	"io"
 	"math/rand"
 	"net/http"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/bmizerany/lpx"
 	"github.com/garyburd/redigo/redis"
-	"github.com/kr/logfmt"
 )
 
 const (
 	Concurrency = 40
+
+	// Longest line accepted in an NDJSON body.
+	NDJSONMaxLine = 1024 * 1024
 )
 
 var (
-	confs     []*IndexConf
-	connPool  *redis.Pool
-	receiver  *Receiver
-	retriever *Retriever
-	verbose   bool
+	admin          *Admin
+	confs          []*IndexConf
+	connPool       *redis.Pool
+	defaultParser  Parser
+	drainParsers   map[string]Parser
+	encryptor      *Encryptor
+	redactPatterns []*RedactPattern
+	redisOptions   *RedisOptions
+	receiver       *Receiver
+	retriever      *Retriever
+	verbose        bool
 )
 
 type IndexConf struct {
+	// Codec used to compress this conf's blobs. Defaults to gzip, and can
+	// be set from the environment with CODECS.
+	codec Codec
+
+	// Used to derive a value from a message's data when a pair matching
+	// key isn't present. Optional.
+	extractor Extractor
+
 	key     string
 	maxSize int
 	ttl     time.Duration
+
+	// Other pair keys whose values are identifiers for this index, like a
+	// `parent_request_id`. Used to follow links when assembling traces.
+	links []string
+
+	// Maximum number of values to keep in this conf's index of recently
+	// written keys. The index is disabled if zero. recentTags are pair keys
+	// (like `at`) whose values are also indexed so that recent keys can be
+	// filtered by them.
+	recentMax  int
+	recentTags []string
+
+	// Maximum number of values to keep for each token in this conf's search
+	// index. Search is disabled if zero.
+	searchMax int
+
+	// Fraction of values to keep, from 0 to 1. Sampling is deterministic on
+	// the value so a request is either kept wholly or not at all. Values
+	// are kept regardless from the first line matching any of the
+	// alwaysKeep predicates onwards. Sampling is disabled if zero.
+	alwaysKeep []*predicate
+	sampleRate float64
+
+	// Maximum number of lines that can be written to a single key each
+	// RateLimitWindow. Disabled if zero.
+	rateLimit int
+
+	// Keys with a line matching any of the interesting predicates have
+	// their TTL extended to interestingTTL, and if feedMax is non-zero, are
+	// listed in a capped feed of interesting values.
+	feedMax        int
+	interesting    []*predicate
+	interestingTTL time.Duration
+
+	// Separator used to split a single value into multiple identifiers
+	// that are stored separately. Values aren't split if empty.
+	separator string
+
+	// Normalization applied to each identifier before it's used to build
+	// a key. Identifiers longer than maxValueLength (if non-zero) or not
+	// matching validValue (if set) are discarded.
+	lowercase      bool
+	maxValueLength int
+	trimSpace      bool
+	validValue     *regexp.Regexp
 }
 
 type LogMessage struct {
@@ -48,12 +111,50 @@ func (m *LogMessage) HandleLogfmt(key, value []byte) error {
 func init() {
 	confs = []*IndexConf{
 		&IndexConf{
+			// also catch lines that aren't logfmt, but which still contain
+			// something like `request-id: abc123` (but not
+			// `parent_request_id`)
+			extractor: NewRegexExtractor(
+				regexp.MustCompile(`(?:^|[^\w])request[-_]id[:=]\s*"?(?P<value>[\w-]+(?:,[\w-]+)*)`),
+				"value"),
 			key:     "request_id",
+			links:   []string{"parent_request_id"},
 			maxSize: 500,
 			ttl:     48 * time.Hour,
+
+			recentMax:  10000,
+			recentTags: []string{"at", "status"},
+			searchMax:  1000,
+
+			alwaysKeep: parsePredicates("at=error status>=500"),
+			rateLimit:  5000,
+
+			feedMax:        1000,
+			interesting:    parsePredicates("at=error status>=500"),
+			interestingTTL: 7 * 24 * time.Hour,
+
+			// Heroku joins multiple request IDs with commas
+			separator:      ",",
+			maxValueLength: 200,
+			trimSpace:      true,
+			validValue:     regexp.MustCompile(`^[\w.:-]+$`),
 		},
 	}
 
+	// sensitive values that are masked wherever they appear in a line
+	redactPatterns = []*RedactPattern{
+		// email addresses
+		{pattern: regexp.MustCompile(`[\w.+-]+@[\w-]+\.[\w.-]+`)},
+		// card numbers, which unlike most long IDs and timestamps have a
+		// valid check digit
+		{
+			pattern: regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`),
+			valid:   luhnValid,
+		},
+		// bearer tokens
+		{pattern: regexp.MustCompile(`(?i)bearer [\w.~+/-]+=*`)},
+	}
+
 	// seed the random number generator
 	rand.Seed(time.Now().Unix())
 }
@@ -61,27 +162,121 @@ func init() {
 func receiveMessage(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
+	// push back on the drain instead of queueing messages that would only
+	// be dropped
+	if receiver.breaker.Open() {
+		w.Header().Set("Retry-After", strconv.Itoa(int(receiver.breaker.cooldown.Seconds())))
+		w.WriteHeader(503)
+		return
+	}
+
+	var messages []*LogMessage
+	if isNDJSON(r) {
+		var err error
+		messages, err = readNDJSON(r.Body)
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(fmt.Sprintf("Couldn't read body: %s", err.Error())))
+			return
+		}
+	} else {
+		messages = readLogplex(r.Body, drainParser(r))
+	}
+
+	// redact on the request's goroutine rather than the single dispatcher
+	receiver.redact(messages)
+
+	printVerbose("queue_messages num=%v\n", len(messages))
+
+	// send through the whole set of messages at once to reduce the
+	// probability of inter-routine contention
+	receiver.MessagesChan <- messages
+	printVerbose("queue size=%v\n", len(receiver.MessagesChan))
+}
+
+// Picks a parser for an incoming Logplex request based off of its drain
+// token, falling back to the default if the drain isn't configured.
+func drainParser(r *http.Request) Parser {
+	if parser, ok := drainParsers[r.Header.Get("Logplex-Drain-Token")]; ok {
+		return parser
+	}
+	if defaultParser != nil {
+		return defaultParser
+	}
+	return parsers["auto"]
+}
+
+func isNDJSON(r *http.Request) bool {
+	contentType := r.Header.Get("Content-Type")
+	return strings.HasPrefix(contentType, "application/x-ndjson") ||
+		strings.HasPrefix(contentType, "application/json")
+}
+
+func readLogplex(body io.Reader, parser Parser) []*LogMessage {
 	messages := make([]*LogMessage, 0)
-	lp := lpx.NewReader(bufio.NewReader(r.Body))
+	lp := lpx.NewReader(bufio.NewReader(body))
 	for lp.Next() {
 		message := &LogMessage{
 			data:  bytes.TrimSpace(lp.Bytes()),
 			pairs: make(map[string]string),
 		}
-		err := logfmt.Unmarshal(message.data, message)
+		err := parser.Parse(message)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Couldn't unmarshal message: "+err.Error())
+			fmt.Fprintf(os.Stderr, "Couldn't unmarshal message: %s\n", err.Error())
 			continue
 		}
 		messages = append(messages, message)
 	}
+	return messages
+}
 
-	printVerbose("queue_messages num=%v\n", len(messages))
+// Reads a body of newline-delimited JSON objects, one message per line.
+// Lines longer than NDJSONMaxLine are skipped like lines that aren't valid
+// JSON, so only an error reading the body itself fails the whole batch.
+func readNDJSON(body io.Reader) ([]*LogMessage, error) {
+	messages := make([]*LogMessage, 0)
+	reader := bufio.NewReader(body)
 
-	// send through the whole set of messages at once to reduce the
-	// probability of inter-routine contention
-	receiver.MessagesChan <- messages
-	printVerbose("queue size=%v\n", len(receiver.MessagesChan))
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(line)+len(chunk) > NDJSONMaxLine {
+			tooLong = true
+		} else if !tooLong {
+			line = append(line, chunk...)
+		}
+
+		// the rest of the line is still to come
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+
+		if tooLong {
+			fmt.Fprintf(os.Stderr, "Couldn't unmarshal message: longer than %v bytes\n",
+				NDJSONMaxLine)
+		} else if data := bytes.TrimSpace(line); len(data) > 0 {
+			message := &LogMessage{
+				data:  append([]byte(nil), data...),
+				pairs: make(map[string]string),
+			}
+			if parseErr := parsers["json"].Parse(message); parseErr != nil {
+				fmt.Fprintf(os.Stderr, "Couldn't unmarshal message: %s\n", parseErr.Error())
+			} else {
+				messages = append(messages, message)
+			}
+		}
+
+		line = line[:0]
+		tooLong = false
+
+		if err == io.EOF {
+			return messages, nil
+		}
+		if err != nil {
+			return messages, err
+		}
+	}
 }
 
 func lookupMessages(w http.ResponseWriter, r *http.Request) {
@@ -93,9 +288,20 @@ func lookupMessages(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	content, ok, err := retriever.Lookup(query)
+	cursor := 0
+	if after := r.FormValue("after"); after != "" {
+		var err error
+		cursor, err = strconv.Atoi(after)
+		if err != nil || cursor < 0 {
+			w.WriteHeader(400)
+			w.Write([]byte("Bad `after` parameter."))
+			return
+		}
+	}
+
+	blob, ok, err := retriever.Lookup(query)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Couldn't perform lookup: "+err.Error())
+		fmt.Fprintf(os.Stderr, "Couldn't perform lookup: %s\n", err.Error())
 		w.WriteHeader(500)
 		return
 	}
@@ -105,26 +311,463 @@ func lookupMessages(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// write directly if the client supports gzip, and a string
-	// directly otherwise
-	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
-		w.Header().Set("Content-Encoding", "gzip")
-		w.Write(content)
-	} else {
-		reader, err := gzip.NewReader(bytes.NewBuffer(content))
+	blob, decompressed, end, err := tailBlob(blob, cursor)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't unpack: %s\n", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Vary", "Accept-Encoding")
+
+	// pass back as `after` to get only lines appended since this lookup
+	w.Header().Set("X-Lvat-Cursor", strconv.Itoa(end))
+
+	// Serve the stored blob directly if the client supports its encoding,
+	// transcode to gzip if the client supports that instead, and decompress
+	// otherwise. Ranges are always over the decompressed content so that a
+	// client can fetch only the lines appended since its last request.
+	candidates := []string{"identity"}
+	if r.Header.Get("Range") == "" {
+		candidates = []string{"gzip", "identity"}
+		if encoding := blob.Codec.ContentEncoding(); encoding != "" &&
+			encoding != "gzip" && encoding != "identity" {
+			candidates = append([]string{encoding}, candidates...)
+		}
+	}
+
+	var data []byte
+	coding := negotiateEncoding(r.Header.Get("Accept-Encoding"), candidates)
+	switch coding {
+	case "":
+		w.WriteHeader(406)
+		return
+	case "identity":
+		data = decompressed
+	case blob.Codec.ContentEncoding():
+		data = blob.Data
+	default:
+		data, err = codecs["gzip"].Compress(decompressed)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't unpack: %s\n", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+
+	if coding != "identity" {
+		w.Header().Set("Content-Encoding", coding)
+	}
+	w.Header().Set("ETag", blobETag(blob, coding))
+
+	// handles conditional requests, ranges, and Content-Length
+	http.ServeContent(w, r, "", blob.LastModified, bytes.NewReader(data))
+}
+
+func searchMessages(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	query := r.FormValue("q")
+	if query == "" {
+		w.WriteHeader(400)
+		w.Write([]byte("Need `q` parameter."))
+		return
+	}
+
+	var conf *IndexConf
+	for _, c := range confs {
+		if c.searchMax > 0 && (r.FormValue("index") == "" || c.key == r.FormValue("index")) {
+			conf = c
+			break
+		}
+	}
+
+	if conf == nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	var since time.Duration
+	var err error
+	if r.FormValue("since") != "" {
+		since, err = time.ParseDuration(r.FormValue("since"))
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Couldn't unpack: "+err.Error())
-			w.WriteHeader(500)
+			w.WriteHeader(400)
+			w.Write([]byte("`since` must be a duration like `10m`."))
 			return
 		}
-		defer reader.Close()
-		io.Copy(w, reader)
 	}
+
+	limit, _ := strconv.Atoi(r.FormValue("limit"))
+
+	results, err := retriever.Search(conf, query, since, limit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't perform search: %s\n", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"results": results,
+	})
+}
+
+func traceMessages(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	query := r.FormValue("query")
+	if query == "" {
+		w.WriteHeader(400)
+		w.Write([]byte("Need `query` parameter."))
+		return
+	}
+
+	depth := TraceMaxDepth
+	if r.FormValue("depth") != "" {
+		var err error
+		depth, err = strconv.Atoi(r.FormValue("depth"))
+		if err != nil || depth < 0 {
+			w.WriteHeader(400)
+			w.Write([]byte("`depth` must be a non-negative integer."))
+			return
+		}
+	}
+
+	lines, ok, err := retriever.Trace(query, depth)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't perform trace: %s\n", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+
+	if !ok {
+		w.WriteHeader(404)
+		return
+	}
+
+	for _, line := range lines {
+		w.Write(line)
+		w.Write([]byte("\n"))
+	}
+}
+
+func listFeed(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var conf *IndexConf
+	key := strings.TrimPrefix(r.URL.Path, "/feeds/")
+	for _, c := range confs {
+		if c.key == key && c.feedMax > 0 {
+			conf = c
+			break
+		}
+	}
+
+	if conf == nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	var since time.Duration
+	var err error
+	if r.FormValue("since") != "" {
+		since, err = time.ParseDuration(r.FormValue("since"))
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte("`since` must be a duration like `10m`."))
+			return
+		}
+	}
+
+	offset, _ := strconv.Atoi(r.FormValue("offset"))
+	limit, _ := strconv.Atoi(r.FormValue("limit"))
+	if offset < 0 {
+		offset = 0
+	}
+
+	feed, err := retriever.Feed(conf, since, offset, limit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't list feed: %s\n", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys":        feed,
+		"next_offset": offset + len(feed),
+	})
+}
+
+func listIndex(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var conf *IndexConf
+	key := strings.TrimPrefix(r.URL.Path, "/indexes/")
+	for _, c := range confs {
+		if c.key == key && c.recentMax > 0 {
+			conf = c
+			break
+		}
+	}
+
+	if conf == nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	// only tagged fields can be used as filters
+	filters := make(map[string]string)
+	for _, tag := range conf.recentTags {
+		if value := r.FormValue(tag); value != "" {
+			filters[tag] = value
+		}
+	}
+
+	var since time.Duration
+	var err error
+	if r.FormValue("since") != "" {
+		since, err = time.ParseDuration(r.FormValue("since"))
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte("`since` must be a duration like `10m`."))
+			return
+		}
+	}
+
+	offset, _ := strconv.Atoi(r.FormValue("offset"))
+	limit, _ := strconv.Atoi(r.FormValue("limit"))
+	if offset < 0 {
+		offset = 0
+	}
+
+	recent, err := retriever.Recent(conf, filters, since, offset, limit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't list index: %s\n", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys":        recent,
+		"next_offset": offset + len(recent),
+	})
+}
+
+func showStats(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	stats, err := retriever.Stats()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't get stats: %s\n", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+
+	body := map[string]interface{}{
+		"indexes": stats,
+	}
+	if receiver != nil {
+		body["receiver"] = receiver.Metrics()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+// Handles the admin endpoints for a single key:
+//
+//	GET    /admin/keys/<index>/<value>       describe the key
+//	DELETE /admin/keys/<index>/<value>       delete the key
+//	POST   /admin/keys/<index>/<value>/pin   pin the key (`ttl` to extend
+//	                                         its TTL instead)
+func adminKeys(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/admin/keys/"), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[1] == "" {
+		w.WriteHeader(404)
+		return
+	}
+
+	conf := admin.findConf(parts[0])
+	if conf == nil {
+		w.WriteHeader(404)
+		return
+	}
+	value := parts[1]
+
+	pin := len(parts) == 3
+	if pin && parts[2] != "pin" {
+		w.WriteHeader(404)
+		return
+	}
+
+	var ok bool
+	var err error
+	switch {
+	case pin && r.Method == "POST":
+		var ttl time.Duration
+		if r.FormValue("ttl") != "" {
+			ttl, err = time.ParseDuration(r.FormValue("ttl"))
+			if err != nil || ttl <= 0 {
+				w.WriteHeader(400)
+				w.Write([]byte("`ttl` must be a duration like `168h`."))
+				return
+			}
+		}
+
+		ok, err = admin.Pin(conf, value, ttl)
+		if err == nil && ok {
+			printVerbose("admin_pin key=%v value=%v ttl=%v\n", conf.key, value, ttl)
+			w.WriteHeader(204)
+			return
+		}
+	case !pin && r.Method == "DELETE":
+		ok, err = admin.Delete(conf, value)
+		if err == nil && ok {
+			printVerbose("admin_delete key=%v value=%v\n", conf.key, value)
+			w.WriteHeader(204)
+			return
+		}
+	case !pin && r.Method == "GET":
+		var info *KeyInfo
+		info, ok, err = admin.Inspect(conf, value)
+		if err == nil && ok {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(info)
+			return
+		}
+	default:
+		w.WriteHeader(404)
+		return
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't manage key: %s\n", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+
+	w.WriteHeader(404)
+}
+
+// Handles the admin endpoints for purging whole indexes:
+//
+//	POST /admin/indexes/<index>/purge   start purging an index
+//	GET  /admin/purges/<id>             check on a purge's progress
+func adminPurges(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var purge *Purge
+	if strings.HasPrefix(r.URL.Path, "/admin/purges/") {
+		if r.Method != "GET" {
+			w.WriteHeader(404)
+			return
+		}
+
+		id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/admin/purges/"))
+		if err != nil {
+			w.WriteHeader(404)
+			return
+		}
+
+		var ok bool
+		purge, ok = admin.FindPurge(id)
+		if !ok {
+			w.WriteHeader(404)
+			return
+		}
+	} else {
+		path := strings.TrimPrefix(r.URL.Path, "/admin/indexes/")
+		if r.Method != "POST" || !strings.HasSuffix(path, "/purge") {
+			w.WriteHeader(404)
+			return
+		}
+
+		conf := admin.findConf(strings.TrimSuffix(path, "/purge"))
+		if conf == nil {
+			w.WriteHeader(404)
+			return
+		}
+
+		purge = admin.Purge(conf)
+		printVerbose("admin_purge id=%v key=%v\n", purge.ID, conf.key)
+		w.Header().Set("Location", fmt.Sprintf("/admin/purges/%v", purge.ID))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(202)
+		json.NewEncoder(w).Encode(purge)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(purge)
+}
+
+// Reports that the process is up. Doesn't depend on anything else so that a
+// dyno isn't restarted because Redis is having trouble.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "ok",
+	})
+}
+
+// Reports whether the dyno is fit to receive traffic.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	ready, checks := checkReadiness(receiver, connPool, ReadyRedisTimeout)
+
+	status := "ok"
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		status = "unavailable"
+		w.WriteHeader(503)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"checks": checks,
+		"status": status,
+	})
 }
 
 func main() {
+	command := "serve"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command = args[0]
+		args = args[1:]
+	}
+
 	var err error
+	switch command {
+	case "serve":
+		err = serve()
+	case "get", "search", "stats", "tail":
+		err = runClient(command, args)
+	case "export":
+		err = exportCommand(args)
+	case "import":
+		err = importCommand(args)
+	case "restore":
+		err = restoreCommand(args)
+	case "train-dict":
+		err = trainDict(args)
+	default:
+		err = fmt.Errorf("Unknown command: %s", command)
+	}
 
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+// Runs lvat as a Logplex drain and serves lookups.
+func serve() error {
 	apiKey := os.Getenv("API_KEY")
 	port := os.Getenv("PORT")
 	redisUrl := os.Getenv("REDIS_URL")
@@ -135,29 +778,58 @@ func main() {
 	}
 
 	if apiKey == "" {
-		err = fmt.Errorf("Need API_KEY")
-		goto exit
+		return fmt.Errorf("Need API_KEY")
 	}
 	if port == "" {
-		err = fmt.Errorf("Need PORT")
-		goto exit
+		return fmt.Errorf("Need PORT")
 	}
 	if redisUrl == "" {
-		err = fmt.Errorf("Need REDIS_URL")
-		goto exit
+		return fmt.Errorf("Need REDIS_URL")
 	}
 
-	if os.Getenv("VERBOSE") == "true" {
-		verbose = true
+	if err := configure(); err != nil {
+		return err
 	}
 
-	connPool = redis.NewPool(redisConnect(redisUrl), Concurrency)
+	serverOptions, err := parseServerOptions()
+	if err != nil {
+		return err
+	}
+
+	workerOptions, err := parseWorkerOptions()
+	if err != nil {
+		return err
+	}
+
+	// keep an idle connection around for every worker that might need one
+	if os.Getenv("REDIS_MAX_IDLE") == "" {
+		redisOptions.maxIdle = workerOptions.maxWorkers
+	}
+
+	connPool = newRedisPool(redisUrl, redisOptions)
 	defer connPool.Close()
 
-	receiver = NewReceiver(confs, connPool)
+	receiver = NewReceiverWithOptions(confs, connPool, workerOptions)
+	breaker, err := parseCircuitBreaker()
+	if err != nil {
+		return err
+	}
+	receiver.breaker = breaker
+	receiver.redactor, err = configuredRedactor()
+	if err != nil {
+		return err
+	}
+	receiver.encryptor = encryptor
 	receiver.Run()
 
 	retriever = NewRetriever(confs, connPool)
+	retriever.encryptor = encryptor
+	retriever.sampler = NewStatsSampler(retriever)
+	retriever.sampler.Run(StatsSampleInterval)
+
+	// unauthenticated so that load balancers can use them
+	http.HandleFunc("/healthz", healthz)
+	http.HandleFunc("/readyz", readyz)
 
 	http.HandleFunc("/messages", func(w http.ResponseWriter, r *http.Request) {
 		if basicAuthPassword(r) != apiKey {
@@ -166,7 +838,7 @@ func main() {
 		}
 
 		switch r.Method {
-		case "GET":
+		case "GET", "HEAD":
 			lookupMessages(w, r)
 		case "POST":
 			receiveMessage(w, r)
@@ -175,16 +847,208 @@ func main() {
 			return
 		}
 	})
-	err = http.ListenAndServe(":"+port, nil)
+	http.HandleFunc("/feeds/", func(w http.ResponseWriter, r *http.Request) {
+		if basicAuthPassword(r) != apiKey {
+			w.WriteHeader(401)
+			return
+		}
+
+		if r.Method != "GET" {
+			w.WriteHeader(404)
+			return
+		}
+
+		listFeed(w, r)
+	})
+	http.HandleFunc("/indexes/", func(w http.ResponseWriter, r *http.Request) {
+		if basicAuthPassword(r) != apiKey {
+			w.WriteHeader(401)
+			return
+		}
+
+		if r.Method != "GET" {
+			w.WriteHeader(404)
+			return
+		}
+
+		listIndex(w, r)
+	})
+	http.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) {
+		if basicAuthPassword(r) != apiKey {
+			w.WriteHeader(401)
+			return
+		}
+
+		if r.Method != "GET" {
+			w.WriteHeader(404)
+			return
+		}
+
+		searchMessages(w, r)
+	})
+	http.HandleFunc("/trace", func(w http.ResponseWriter, r *http.Request) {
+		if basicAuthPassword(r) != apiKey {
+			w.WriteHeader(401)
+			return
+		}
+
+		if r.Method != "GET" {
+			w.WriteHeader(404)
+			return
+		}
+
+		traceMessages(w, r)
+	})
+	http.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		if basicAuthPassword(r) != apiKey {
+			w.WriteHeader(401)
+			return
+		}
+
+		if r.Method != "GET" {
+			w.WriteHeader(404)
+			return
+		}
+
+		showStats(w, r)
+	})
+
+	// admin endpoints are only available with their own key, which unlike
+	// API_KEY isn't embedded in drain URLs
+	if adminApiKey := os.Getenv("ADMIN_API_KEY"); adminApiKey != "" {
+		admin = NewAdmin(confs, connPool)
+		admin.encryptor = encryptor
+
+		adminHandler := func(handler http.HandlerFunc) http.HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request) {
+				if basicAuthPassword(r) != adminApiKey {
+					w.WriteHeader(401)
+					return
+				}
+				handler(w, r)
+			}
+		}
+		http.HandleFunc("/admin/keys/", adminHandler(adminKeys))
+		http.HandleFunc("/admin/indexes/", adminHandler(adminPurges))
+		http.HandleFunc("/admin/purges/", adminHandler(adminPurges))
+	}
+
+	server, reloader, err := newServer(":"+port, nil, serverOptions)
+	if err != nil {
+		return err
+	}
+	if reloader != nil {
+		reloader.Watch(CertReloadInterval)
+	}
+
+	return listenAndServe(server)
+}
+
+// Configures parsing, encryption, and compression from the environment.
+// Shared by every command that reads or writes stored blobs.
+func configure() error {
+	var err error
+
+	if os.Getenv("VERBOSE") == "true" {
+		verbose = true
+	}
+
+	redisOptions, err = parseRedisOptions()
+	if err != nil {
+		return err
+	}
+
+	if os.Getenv("PARSER") != "" {
+		defaultParser, err = findParser(os.Getenv("PARSER"))
+		if err != nil {
+			return err
+		}
+	}
+
+	drainParsers, err = parseDrainParsers(os.Getenv("DRAIN_PARSERS"))
+	if err != nil {
+		return err
+	}
+
+	encryptor, err = parseEncryptionKeys(os.Getenv("ENCRYPTION_KEYS"))
+	if err != nil {
+		return err
+	}
+
+	if os.Getenv("CODEC") != "" {
+		var codec Codec
+		codec, err = parseCodec(os.Getenv("CODEC"))
+		if err != nil {
+			return err
+		}
+
+		for _, conf := range confs {
+			conf.codec = codec
+		}
+	}
+
+	if os.Getenv("ZSTD_DICTIONARY_DIR") != "" {
+		err = loadDictionaries(os.Getenv("ZSTD_DICTIONARY_DIR"))
+		if err != nil {
+			return err
+		}
+	}
+
+	// a trained dictionary takes precedence over any other codec
+	if os.Getenv("ZSTD_DICTIONARY") != "" {
+		var codec *ZstdCodec
+		codec, err = loadDictionary(os.Getenv("ZSTD_DICTIONARY"), 3)
+		if err != nil {
+			return err
+		}
+
+		for _, conf := range confs {
+			conf.codec = codec
+		}
+	}
+
+	err = parseJSONPaths(os.Getenv("JSON_PATHS"), confs)
 	if err != nil {
-		goto exit
+		return err
 	}
 
-exit:
+	// codecs configured for a particular index take precedence over all
+	// of the above
+	indexCodecs, err := parseIndexCodecs(os.Getenv("CODECS"), confs)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, err.Error()+"\n")
-		defer os.Exit(1)
+		return err
+	}
+	for _, conf := range confs {
+		if codec, ok := indexCodecs[conf.key]; ok {
+			conf.codec = codec
+		}
+	}
+
+	return nil
+}
+
+// Builds a redactor from the environment. The keys that messages are indexed
+// under are never redacted.
+func configuredRedactor() (*Redactor, error) {
+	hashKeys := strings.Split(os.Getenv("REDACT_HASH_KEYS"), ",")
+	if len(toSet(hashKeys)) > 0 && os.Getenv("REDACT_HASH_KEY") == "" {
+		// without a secret key, hashed values could be recovered by hashing
+		// guesses at them
+		return nil, fmt.Errorf("Need REDACT_HASH_KEY with REDACT_HASH_KEYS")
 	}
+
+	indexKeys := make([]string, len(confs))
+	for i, conf := range confs {
+		indexKeys[i] = conf.key
+	}
+
+	return NewRedactor(
+		strings.Split(os.Getenv("REDACT_DROP_KEYS"), ","),
+		strings.Split(os.Getenv("REDACT_MASK_KEYS"), ","),
+		hashKeys,
+		indexKeys,
+		redactPatterns,
+		[]byte(os.Getenv("REDACT_HASH_KEY"))), nil
 }
 
 func printVerbose(message string, args ...interface{}) {
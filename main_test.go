@@ -15,12 +15,13 @@ func init() {
 	env := map[string]string{
 		"REDIS_URL": "redis://localhost:6379",
 	}
-	connPool = redis.NewPool(redisConnect(env["REDIS_URL"]), 1)
+	connPool = redis.NewPool(redisConnect(env["REDIS_URL"], nil), 1)
 
 	conf = &IndexConf{
-		key:     "request_id",
-		maxSize: 2,
-		ttl:     1 * time.Hour,
+		key:       "request_id",
+		maxSize:   2,
+		separator: ",",
+		ttl:       1 * time.Hour,
 	}
 }
 
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// Parses an Accept-Encoding header into a map of content codings to their
+// quality values.
+func parseAcceptEncoding(header string) map[string]float64 {
+	accepted := make(map[string]float64)
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				parsed, err := strconv.ParseFloat(param[2:], 64)
+				if err != nil {
+					parsed = 0
+				}
+				q = parsed
+			}
+		}
+		accepted[coding] = q
+	}
+	return accepted
+}
+
+// Gets the quality value that a client gave a content coding, falling back
+// to a wildcard if it was given. Identity is always acceptable unless it's
+// explicitly excluded.
+func acceptQuality(accepted map[string]float64, coding string) float64 {
+	if q, ok := accepted[coding]; ok {
+		return q
+	}
+	if q, ok := accepted["*"]; ok {
+		return q
+	}
+	if coding == "identity" {
+		return 1.0
+	}
+	return 0
+}
+
+// Picks the content coding that a client most prefers out of a set of
+// candidates ordered by our own preference, which breaks ties. Returns an
+// empty string if none are acceptable.
+func negotiateEncoding(header string, candidates []string) string {
+	accepted := parseAcceptEncoding(header)
+
+	best := ""
+	bestQ := 0.0
+	for _, candidate := range candidates {
+		q := acceptQuality(accepted, candidate)
+		if q > bestQ {
+			best = candidate
+			bestQ = q
+		}
+	}
+	return best
+}
+
+// Produces an entity tag for a representation of a blob. Blobs are only ever
+// rewritten when lines are appended to them, so the tag changes exactly when
+// a trace grows. Each content coding gets its own tag because they're
+// different representations.
+func blobETag(blob *Blob, coding string) string {
+	hash := sha1.Sum(blob.Data)
+	tag := hex.EncodeToString(hash[:])[0:16]
+	if coding != "identity" {
+		tag += "-" + coding
+	}
+	return `"` + tag + `"`
+}
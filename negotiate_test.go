@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	candidates := []string{"zstd", "gzip", "identity"}
+	cases := []struct {
+		header   string
+		expected string
+	}{
+		{"", "identity"},
+		{"gzip", "gzip"},
+		{"gzip, zstd", "zstd"},
+		{"gzip;q=1.0, zstd;q=0.5", "gzip"},
+		{"gzip;q=0", "identity"},
+		{"GZIP", "gzip"},
+		{"br", "identity"},
+		{"*", "zstd"},
+		{"*;q=0.5, gzip", "gzip"},
+		{"identity;q=0, zstd", "zstd"},
+		{"*;q=0", ""},
+		{"identity;q=0, br", ""},
+	}
+
+	for _, c := range cases {
+		actual := negotiateEncoding(c.header, candidates)
+		if actual != c.expected {
+			t.Errorf("Expected %q to negotiate %v, got %v\n",
+				c.header, c.expected, actual)
+		}
+	}
+}
+
+func TestBlobETag(t *testing.T) {
+	blob := &Blob{Codec: codecs["gzip"], Data: []byte("data")}
+	other := &Blob{Codec: codecs["gzip"], Data: []byte("more data")}
+
+	if blobETag(blob, "gzip") == blobETag(other, "gzip") {
+		t.Errorf("Expected different blobs to have different tags\n")
+	}
+	if blobETag(blob, "gzip") == blobETag(blob, "identity") {
+		t.Errorf("Expected different codings to have different tags\n")
+	}
+	if blobETag(blob, "gzip") != blobETag(blob, "gzip") {
+		t.Errorf("Expected tags to be stable\n")
+	}
+}
+
+func TestLookupMessagesNegotiation(t *testing.T) {
+	setup(t)
+
+	receiver := NewReceiver([]*IndexConf{conf}, connPool)
+	retriever = NewRetriever([]*IndexConf{conf}, connPool)
+
+	_, err := receiver.compress(conf, "req1", [][]byte{[]byte("request_id=req1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lookup := func(header map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/messages?query=req1", nil)
+		for name, value := range header {
+			r.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		lookupMessages(w, r)
+		return w
+	}
+
+	w := lookup(map[string]string{"Accept-Encoding": "gzip"})
+	if w.Code != 200 {
+		t.Fatalf("Expected code 200, got %v\n", w.Code)
+	}
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("Expected encoding gzip, got %v\n", w.Header().Get("Content-Encoding"))
+	}
+	if w.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("Expected Vary Accept-Encoding, got %v\n", w.Header().Get("Vary"))
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Errorf("Expected an ETag\n")
+	}
+
+	w = lookup(map[string]string{"Accept-Encoding": "gzip", "If-None-Match": etag})
+	if w.Code != 304 {
+		t.Errorf("Expected code 304, got %v\n", w.Code)
+	}
+
+	w = lookup(map[string]string{"Accept-Encoding": "gzip;q=0"})
+	if w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("Expected no encoding, got %v\n", w.Header().Get("Content-Encoding"))
+	}
+	if w.Body.String() != "request_id=req1\n" {
+		t.Errorf("Expected body %q, got %q\n", "request_id=req1\n", w.Body.String())
+	}
+
+	w = lookup(map[string]string{"Accept-Encoding": "gzip", "Range": "bytes=11-"})
+	if w.Code != 206 {
+		t.Errorf("Expected code 206, got %v\n", w.Code)
+	}
+	if w.Body.String() != "req1\n" {
+		t.Errorf("Expected body %q, got %q\n", "req1\n", w.Body.String())
+	}
+
+	w = lookup(map[string]string{"Accept-Encoding": "*;q=0"})
+	if w.Code != 406 {
+		t.Errorf("Expected code 406, got %v\n", w.Code)
+	}
+}
+
+func TestLookupMessagesAfter(t *testing.T) {
+	setup(t)
+
+	receiver := NewReceiver([]*IndexConf{conf}, connPool)
+	retriever = NewRetriever([]*IndexConf{conf}, connPool)
+
+	lookup := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		lookupMessages(w, httptest.NewRequest("GET", url, nil))
+		return w
+	}
+
+	_, err := receiver.compress(conf, "req1", [][]byte{[]byte("request_id=req1 n=1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := lookup("/messages?query=req1")
+	cursor := w.Header().Get("X-Lvat-Cursor")
+	if cursor != "1" {
+		t.Errorf("Expected cursor %v, got %v\n", "1", cursor)
+	}
+
+	_, err = receiver.compress(conf, "req1", [][]byte{[]byte("request_id=req1 n=2")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = lookup("/messages?query=req1&after=" + cursor)
+	if w.Body.String() != "request_id=req1 n=2\n" {
+		t.Errorf("Expected body %q, got %q\n", "request_id=req1 n=2\n", w.Body.String())
+	}
+	if w.Header().Get("X-Lvat-Cursor") != "2" {
+		t.Errorf("Expected cursor %v, got %v\n", "2", w.Header().Get("X-Lvat-Cursor"))
+	}
+
+	w = lookup("/messages?query=req1&after=2")
+	if w.Code != 200 || w.Body.Len() != 0 {
+		t.Errorf("Expected an empty 200, got %v %q\n", w.Code, w.Body.String())
+	}
+
+	w = lookup("/messages?query=req1&after=-1")
+	if w.Code != 400 {
+		t.Errorf("Expected code 400, got %v\n", w.Code)
+	}
+}
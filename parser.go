@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/kr/logfmt"
+)
+
+// Parser extracts the key/value pairs out of a message's data so that they
+// can be matched against each IndexConf's key.
+type Parser interface {
+	Parse(message *LogMessage) error
+}
+
+var (
+	parsers = map[string]Parser{
+		"auto":   &SniffingParser{},
+		"json":   &JSONParser{},
+		"logfmt": &LogfmtParser{},
+		"raw":    &RawParser{},
+	}
+)
+
+// Looks up a parser by name, returning an error if it isn't one that we
+// know about.
+func findParser(name string) (Parser, error) {
+	parser, ok := parsers[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown parser: %s", name)
+	}
+	return parser, nil
+}
+
+// Parses a drain configuration string of the form `token=parser,...` into a
+// map of Logplex drain tokens to the parser that should be used for them.
+func parseDrainParsers(conf string) (map[string]Parser, error) {
+	drainParsers := make(map[string]Parser)
+	if conf == "" {
+		return drainParsers, nil
+	}
+
+	for _, pair := range strings.Split(conf, ",") {
+		i := strings.IndexRune(pair, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("Bad drain parser pair: %s", pair)
+		}
+
+		parser, err := findParser(pair[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		drainParsers[pair[0:i]] = parser
+	}
+
+	return drainParsers, nil
+}
+
+// JSONParser handles messages that are a single JSON object. Nested objects
+// are flattened into pairs using dotted paths so that `{"request":{"id":1}}`
+// produces `request.id=1`.
+type JSONParser struct{}
+
+func (p *JSONParser) Parse(message *LogMessage) error {
+	decoder := json.NewDecoder(bytes.NewReader(message.data))
+	decoder.UseNumber()
+
+	var object map[string]interface{}
+	err := decoder.Decode(&object)
+	if err != nil {
+		return err
+	}
+
+	flattenJSON(message.pairs, "", object)
+	return nil
+}
+
+// LogfmtParser handles messages made up of logfmt pairs like `key=value`.
+type LogfmtParser struct{}
+
+func (p *LogfmtParser) Parse(message *LogMessage) error {
+	return logfmt.Unmarshal(message.data, message)
+}
+
+// RawParser produces no pairs at all. Messages parsed with it will only be
+// indexed by extraction-based configurations.
+type RawParser struct{}
+
+func (p *RawParser) Parse(message *LogMessage) error {
+	return nil
+}
+
+// SniffingParser looks at a message's content and hands it off to the JSON
+// parser if it looks like an object, or the logfmt parser otherwise. Lines
+// that start like an object but aren't valid JSON fall back to logfmt.
+type SniffingParser struct{}
+
+func (p *SniffingParser) Parse(message *LogMessage) error {
+	if len(message.data) > 0 && message.data[0] == '{' {
+		if err := parsers["json"].Parse(message); err == nil {
+			return nil
+		}
+
+		// a partial decode may have left pairs behind
+		message.pairs = make(map[string]string)
+	}
+	return parsers["logfmt"].Parse(message)
+}
+
+// Flattens a decoded JSON value into pairs. Arrays of scalar values are
+// joined with commas so that they're indexed as separate identifiers like
+// Heroku's comma-joined request IDs; arrays containing objects are
+// flattened by index.
+func flattenJSON(pairs map[string]string, path string, value interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, subValue := range v {
+			flattenJSON(pairs, joinPath(path, key), subValue)
+		}
+	case []interface{}:
+		scalars := make([]string, 0, len(v))
+		for i, subValue := range v {
+			switch subValue.(type) {
+			case map[string]interface{}, []interface{}:
+				flattenJSON(pairs, joinPath(path, strconv.Itoa(i)), subValue)
+			default:
+				scalars = append(scalars, jsonScalar(subValue))
+			}
+		}
+		if len(scalars) > 0 {
+			pairs[path] = strings.Join(scalars, ",")
+		}
+	default:
+		pairs[path] = jsonScalar(v)
+	}
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func jsonScalar(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
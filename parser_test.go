@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestJSONParser(t *testing.T) {
+	message := &LogMessage{
+		data: []byte(`{"request":{"id":"req1","ids":["req2","req3"]},` +
+			`"status":500,"ok":false,"tags":[{"name":"a"}]}`),
+		pairs: make(map[string]string),
+	}
+
+	err := parsers["json"].Parse(message)
+	if err != nil {
+		t.Error(err)
+	}
+
+	expected := map[string]string{
+		"request.id":  "req1",
+		"request.ids": "req2,req3",
+		"status":      "500",
+		"ok":          "false",
+		"tags.0.name": "a",
+	}
+	if len(expected) != len(message.pairs) {
+		t.Errorf("Expected %v pairs, got %v\n", len(expected), len(message.pairs))
+	}
+	for key, value := range expected {
+		if message.pairs[key] != value {
+			t.Errorf("Expected %v=%v, got %v\n", key, value, message.pairs[key])
+		}
+	}
+}
+
+func TestRawParser(t *testing.T) {
+	message := &LogMessage{
+		data:  []byte("request_id=req1"),
+		pairs: make(map[string]string),
+	}
+
+	err := parsers["raw"].Parse(message)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(message.pairs) != 0 {
+		t.Errorf("Expected no pairs, got %v\n", len(message.pairs))
+	}
+}
+
+func TestSniffingParser(t *testing.T) {
+	for _, data := range []string{`{"request_id":"req1"}`, "request_id=req1"} {
+		message := &LogMessage{
+			data:  []byte(data),
+			pairs: make(map[string]string),
+		}
+
+		err := parsers["auto"].Parse(message)
+		if err != nil {
+			t.Error(err)
+		}
+		if message.pairs["request_id"] != "req1" {
+			t.Errorf("Expected request_id %v, got %v\n", "req1",
+				message.pairs["request_id"])
+		}
+	}
+}
+
+func TestSniffingParserFallback(t *testing.T) {
+	message := &LogMessage{
+		data:  []byte("{truncated request_id=req1"),
+		pairs: make(map[string]string),
+	}
+
+	err := parsers["auto"].Parse(message)
+	if err != nil {
+		t.Error(err)
+	}
+	if message.pairs["request_id"] != "req1" {
+		t.Errorf("Expected request_id %v, got %v\n", "req1",
+			message.pairs["request_id"])
+	}
+}
+
+func TestParseDrainParsers(t *testing.T) {
+	drainParsers, err := parseDrainParsers("d.1=json,d.2=raw")
+	if err != nil {
+		t.Error(err)
+	}
+	if drainParsers["d.1"] != parsers["json"] {
+		t.Errorf("Expected json parser for d.1\n")
+	}
+	if drainParsers["d.2"] != parsers["raw"] {
+		t.Errorf("Expected raw parser for d.2\n")
+	}
+
+	_, err = parseDrainParsers("d.1=xml")
+	if err == nil {
+		t.Errorf("Expected error for unknown parser\n")
+	}
+}
+
+func TestReadNDJSON(t *testing.T) {
+	r, _ := http.NewRequest("POST", "/messages",
+		strings.NewReader("{\"request_id\":\"req1\"}\n\n{\"request_id\":\"req2\"}\nnot json\n"))
+	r.Header.Set("Content-Type", "application/x-ndjson")
+
+	if !isNDJSON(r) {
+		t.Errorf("Expected request to be detected as NDJSON\n")
+	}
+
+	messages, err := readNDJSON(r.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 {
+		t.Errorf("Expected messages length %v, got %v\n", 2, len(messages))
+	}
+	if messages[1].pairs["request_id"] != "req2" {
+		t.Errorf("Expected request_id %v, got %v\n", "req2",
+			messages[1].pairs["request_id"])
+	}
+}
+
+func TestReadNDJSONLongLine(t *testing.T) {
+	long := `{"request_id":"req1","data":"` + strings.Repeat("a", NDJSONMaxLine) + "\"}\n"
+	body := long + "{\"request_id\":\"req2\"}\n"
+
+	// only the long line is skipped
+	messages, err := readNDJSON(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].pairs["request_id"] != "req2" {
+		t.Errorf("Expected only the message for req2, got %v\n", messages)
+	}
+
+	receiver = NewReceiver([]*IndexConf{conf}, connPool)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/messages", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-ndjson")
+	receiveMessage(w, r)
+	if w.Code != 200 {
+		t.Errorf("Expected code 200, got %v\n", w.Code)
+	}
+	if len(receiver.MessagesChan) != 1 {
+		t.Errorf("Expected %v batch queued, got %v\n", 1, len(receiver.MessagesChan))
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// Idle connections are PINGed before they're reused if they've been idle
+	// for longer than this.
+	RedisTestIdleAfter = 1 * time.Minute
+)
+
+// RedisOptions configures connections to Redis and the pool that holds them.
+// Zero timeouts mean no timeout, and a zero maxActive means no limit.
+type RedisOptions struct {
+	connectTimeout time.Duration
+	idleTimeout    time.Duration
+	maxActive      int
+	maxIdle        int
+	readTimeout    time.Duration
+	writeTimeout   time.Duration
+
+	// Used for `rediss` URLs. Optional.
+	tlsConfig *tls.Config
+}
+
+func defaultRedisOptions() *RedisOptions {
+	return &RedisOptions{
+		connectTimeout: 5 * time.Second,
+		idleTimeout:    4 * time.Minute,
+		maxIdle:        Concurrency,
+		readTimeout:    5 * time.Second,
+		writeTimeout:   5 * time.Second,
+	}
+}
+
+// Reads Redis options from the environment, using defaults for any that
+// aren't set.
+func parseRedisOptions() (*RedisOptions, error) {
+	options := defaultRedisOptions()
+
+	durations := map[string]*time.Duration{
+		"REDIS_CONNECT_TIMEOUT": &options.connectTimeout,
+		"REDIS_IDLE_TIMEOUT":    &options.idleTimeout,
+		"REDIS_READ_TIMEOUT":    &options.readTimeout,
+		"REDIS_WRITE_TIMEOUT":   &options.writeTimeout,
+	}
+	for name, duration := range durations {
+		if os.Getenv(name) == "" {
+			continue
+		}
+
+		var err error
+		*duration, err = time.ParseDuration(os.Getenv(name))
+		if err != nil || *duration < 0 {
+			return nil, fmt.Errorf("%s must be a duration like `5s`", name)
+		}
+	}
+
+	ints := map[string]*int{
+		"REDIS_MAX_ACTIVE": &options.maxActive,
+		"REDIS_MAX_IDLE":   &options.maxIdle,
+	}
+	for name, value := range ints {
+		if os.Getenv(name) == "" {
+			continue
+		}
+
+		var err error
+		*value, err = strconv.Atoi(os.Getenv(name))
+		if err != nil || *value < 0 {
+			return nil, fmt.Errorf("%s must be a non-negative integer", name)
+		}
+	}
+
+	tlsConfig, err := parseRedisTLS()
+	if err != nil {
+		return nil, err
+	}
+	options.tlsConfig = tlsConfig
+
+	return options, nil
+}
+
+// Builds the TLS configuration for `rediss` URLs from the environment:
+// REDIS_TLS_CA is a bundle of CA certificates to trust instead of the
+// system's, REDIS_TLS_CERT and REDIS_TLS_KEY are a client certificate, and
+// REDIS_TLS_SKIP_VERIFY disables verification for providers that use
+// self-signed certificates.
+func parseRedisTLS() (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if path := os.Getenv("REDIS_TLS_CA"); path != "" {
+		pem, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in REDIS_TLS_CA")
+		}
+	}
+
+	certPath, keyPath := os.Getenv("REDIS_TLS_CERT"), os.Getenv("REDIS_TLS_KEY")
+	if certPath != "" || keyPath != "" {
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("Bad REDIS_TLS_CERT or REDIS_TLS_KEY: %s", err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if os.Getenv("REDIS_TLS_SKIP_VERIFY") == "true" {
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	return tlsConfig, nil
+}
+
+// Builds a pool of connections to Redis. When the pool is at its limit of
+// active connections, callers wait for one to be returned instead of
+// failing.
+func newRedisPool(redisUrl string, options *RedisOptions) *redis.Pool {
+	return &redis.Pool{
+		Dial:        redisConnect(redisUrl, options),
+		IdleTimeout: options.idleTimeout,
+		MaxActive:   options.maxActive,
+		MaxIdle:     options.maxIdle,
+		TestOnBorrow: func(conn redis.Conn, returned time.Time) error {
+			if time.Since(returned) < RedisTestIdleAfter {
+				return nil
+			}
+			_, err := conn.Do("PING")
+			return err
+		},
+		Wait: options.maxActive > 0,
+	}
+}
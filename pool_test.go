@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseRedisOptions(t *testing.T) {
+	defer os.Unsetenv("REDIS_READ_TIMEOUT")
+	defer os.Unsetenv("REDIS_MAX_ACTIVE")
+
+	os.Setenv("REDIS_READ_TIMEOUT", "250ms")
+	os.Setenv("REDIS_MAX_ACTIVE", "80")
+
+	options, err := parseRedisOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.readTimeout != 250*time.Millisecond {
+		t.Errorf("Expected read timeout %v, got %v\n", 250*time.Millisecond, options.readTimeout)
+	}
+	if options.maxActive != 80 {
+		t.Errorf("Expected max active %v, got %v\n", 80, options.maxActive)
+	}
+	if options.writeTimeout != defaultRedisOptions().writeTimeout {
+		t.Errorf("Expected default write timeout, got %v\n", options.writeTimeout)
+	}
+
+	os.Setenv("REDIS_READ_TIMEOUT", "soon")
+	if _, err := parseRedisOptions(); err == nil {
+		t.Errorf("Expected an error for a bad timeout\n")
+	}
+}
+
+func TestRedisPool(t *testing.T) {
+	options := defaultRedisOptions()
+	options.maxActive = 1
+
+	pool := newRedisPool("redis://localhost:6379", options)
+	defer pool.Close()
+
+	conn := pool.Get()
+	if _, err := conn.Do("PING"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the pool waits for the active connection to be returned
+	released := make(chan bool)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		conn.Close()
+		released <- true
+	}()
+
+	other := pool.Get()
+	defer other.Close()
+	select {
+	case <-released:
+	default:
+		t.Errorf("Expected Get to wait for a connection\n")
+	}
+
+	if _, err := other.Do("PING"); err != nil {
+		t.Error(err)
+	}
+}
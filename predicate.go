@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// Operators supported by predicates, ordered so that two character
+// operators are matched before their one character prefixes.
+var predicateOperators = []string{">=", "<=", "!=", "=", ">", "<"}
+
+// A predicate is either a word that must appear in a line or a comparison
+// against one of its pairs like `at=error` or `status>=500`.
+type predicate struct {
+	key   string
+	op    string
+	term  string
+	value string
+}
+
+// Parses whitespace-separated predicates out of a string.
+func parsePredicates(s string) []*predicate {
+	predicates := make([]*predicate, 0)
+	for _, term := range strings.Fields(s) {
+		p := &predicate{term: strings.ToLower(term)}
+		for _, op := range predicateOperators {
+			i := strings.Index(term, op)
+			if i > 0 {
+				p = &predicate{
+					key:   term[0:i],
+					op:    op,
+					value: term[i+len(op):],
+				}
+				break
+			}
+		}
+		predicates = append(predicates, p)
+	}
+	return predicates
+}
+
+func (p *predicate) matches(message *LogMessage) bool {
+	if p.term != "" {
+		return bytes.Contains(bytes.ToLower(message.data), []byte(p.term))
+	}
+
+	value, ok := message.pairs[p.key]
+	if !ok {
+		return p.op == "!="
+	}
+
+	// compare numerically if possible, and as strings otherwise
+	var cmp int
+	actualNum, err1 := strconv.ParseFloat(value, 64)
+	expectedNum, err2 := strconv.ParseFloat(p.value, 64)
+	if err1 == nil && err2 == nil {
+		switch {
+		case actualNum < expectedNum:
+			cmp = -1
+		case actualNum > expectedNum:
+			cmp = 1
+		}
+	} else {
+		cmp = strings.Compare(value, p.value)
+	}
+
+	switch p.op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	}
+	return false
+}
+
+func matchesAll(predicates []*predicate, message *LogMessage) bool {
+	for _, p := range predicates {
+		if !p.matches(message) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchesAny(predicates []*predicate, message *LogMessage) bool {
+	for _, p := range predicates {
+		if p.matches(message) {
+			return true
+		}
+	}
+	return false
+}
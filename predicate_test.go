@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestParsePredicates(t *testing.T) {
+	predicates := parsePredicates("Timeout at=error status>=500")
+	if len(predicates) != 3 {
+		t.Fatalf("Expected predicates length %v, got %v\n", 3, len(predicates))
+	}
+
+	if predicates[0].term != "timeout" {
+		t.Errorf("Expected term %v, got %v\n", "timeout", predicates[0].term)
+	}
+	if predicates[1].key != "at" || predicates[1].op != "=" ||
+		predicates[1].value != "error" {
+		t.Errorf("Expected predicate at=error, got %+v\n", predicates[1])
+	}
+	if predicates[2].key != "status" || predicates[2].op != ">=" ||
+		predicates[2].value != "500" {
+		t.Errorf("Expected predicate status>=500, got %+v\n", predicates[2])
+	}
+}
+
+func TestPredicateMatches(t *testing.T) {
+	message := &LogMessage{
+		data: []byte("at=error status=503 msg=Timeout"),
+		pairs: map[string]string{
+			"at":     "error",
+			"msg":    "Timeout",
+			"status": "503",
+		},
+	}
+
+	matching := []string{"timeout", "at=error", "status>=500", "status<600",
+		"status!=500", "code!=1"}
+	for _, s := range matching {
+		if !matchesAll(parsePredicates(s), message) {
+			t.Errorf("Expected %v to match\n", s)
+		}
+	}
+
+	nonMatching := []string{"ok", "at=info", "status>503", "status<=500",
+		"code=1"}
+	for _, s := range nonMatching {
+		if matchesAll(parsePredicates(s), message) {
+			t.Errorf("Expected %v not to match\n", s)
+		}
+	}
+
+	if !matchesAny(parsePredicates("at=info status>=500"), message) {
+		t.Errorf("Expected any to match\n")
+	}
+}
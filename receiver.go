@@ -2,42 +2,135 @@ package main
 
 import (
 	"bytes"
-	"compress/gzip"
 	"fmt"
 	"math/rand"
-	"io"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
 )
 
 const (
-	BufferSize     = 200
-	CompressBuffer = 300
-	LockRetries    = 5
+	BufferSize      = 200
+	CompressBuffer  = 300
+	LockRetries     = 5
+	RateLimitWindow = 1 * time.Minute
+
+	// Written after the last line of a key that's reached its maxSize.
+	TruncatedMarker = "lvat truncated=true max_size=%v"
 )
 
 type Receiver struct {
 	MessagesChan chan []*LogMessage
 	confs        []*IndexConf
 	connPool     *redis.Pool
+	limiter      *RateLimiter
+
+	// Encrypts stored blobs. Optional.
+	encryptor *Encryptor
+
+	// Fails stores fast when Redis is consistently erroring. Optional.
+	breaker *CircuitBreaker
+
+	// Scrubs messages before they're grouped and stored. Optional.
+	redactor *Redactor
+
+	// Unsampled values that have been decided to be kept.
+	sampleDecisions *SampleDecisions
+
+	options *WorkerOptions
+
+	// Number of shards allowed to write to Redis at once, the number
+	// writing, and the number of shard workers running. Updated
+	// atomically, with writing also guarded by writingMutex so that shards
+	// can wait on writingCond for their turn.
+	target       int32
+	workers      int32
+	writing      int32
+	writingCond  *sync.Cond
+	writingMutex sync.Mutex
+
+	// Sum and count of store latencies since concurrency was last adjusted,
+	// and the average as of then. Updated atomically.
+	lastLatency  int64
+	latencyCount int64
+	latencyTotal int64
+
+	// Conflicts with other writers to the same key, counted every time
+	// that a WATCH fails. Updated atomically.
+	conflicts int64
+
+	// Work for each key is routed to one of maxWorkers shards, each of
+	// which is handled by a single worker so that writes to a key are
+	// serialized within the process. Scaling only changes how many of them
+	// write at once, so keys never move between shards.
+	shards []chan *StoreJob
+
+	// Closed once MessagesChan is closed and every shard has finished the
+	// work routed to it.
+	done chan struct{}
 }
 
 type StorageGroup map[*IndexConf]map[string][][]byte
 
 func NewReceiver(confs []*IndexConf, connPool *redis.Pool) *Receiver {
-	return &Receiver{
-		MessagesChan: make(chan []*LogMessage, BufferSize),
-		confs:        confs,
-		connPool:     connPool,
+	return NewReceiverWithOptions(confs, connPool, defaultWorkerOptions())
+}
+
+func NewReceiverWithOptions(confs []*IndexConf, connPool *redis.Pool,
+	options *WorkerOptions) *Receiver {
+
+	shards := make([]chan *StoreJob, options.maxWorkers)
+	for i := range shards {
+		shards[i] = make(chan *StoreJob, ShardBufferSize)
 	}
+
+	r := &Receiver{
+		MessagesChan:    make(chan []*LogMessage, options.queueSize),
+		confs:           confs,
+		connPool:        connPool,
+		done:            make(chan struct{}),
+		limiter:         NewRateLimiter(RateLimitWindow),
+		options:         options,
+		sampleDecisions: NewSampleDecisions(),
+		shards:          shards,
+	}
+	r.writingCond = sync.NewCond(&r.writingMutex)
+	return r
 }
 
+// Starts the dispatcher and a worker for every shard with the minimum number
+// of them writing at once, and adjusts that number from then on if
+// concurrency is adaptive. Everything runs until MessagesChan is closed and
+// the work already queued is finished.
 func (r *Receiver) Run() {
-	for i := 0; i < Concurrency; i++ {
-		go r.handleMessage()
+	r.scale(r.options.minWorkers)
+
+	var shards sync.WaitGroup
+	for i := range r.shards {
+		shards.Add(1)
+		go func(i int) {
+			defer shards.Done()
+			r.handleShard(i)
+		}(i)
+	}
+
+	// a single dispatcher routes batches in the order that they were
+	// received so that each key's lines are written in order too
+	go func() {
+		r.dispatch()
+		for _, shard := range r.shards {
+			close(shard)
+		}
+		shards.Wait()
+		close(r.done)
+	}()
+
+	if r.options.maxWorkers > r.options.minWorkers {
+		go r.adapt()
 	}
 }
 
@@ -52,14 +145,12 @@ func (r *Receiver) buildGroups(messages []*LogMessage) StorageGroup {
 
 	for _, message := range messages {
 		for _, conf := range r.confs {
-			if value, ok := message.pairs[conf.key]; ok {
+			if value, ok := indexValue(conf, message); ok {
 				if _, ok = groups[conf]; !ok {
 					groups[conf] = make(map[string][][]byte)
 				}
 
-				// assume that multiple values split by commas are
-				// different identifiers that should be stored separately
-				for _, subValue := range strings.Split(value, ",") {
+				for _, subValue := range normalizeValues(conf, value) {
 					if _, ok = groups[conf][subValue]; !ok {
 						groups[conf][subValue] = make([][]byte, 0, 1)
 					}
@@ -74,15 +165,113 @@ func (r *Receiver) buildGroups(messages []*LogMessage) StorageGroup {
 	return groups
 }
 
-func (r *Receiver) compress(conf *IndexConf, value string, lines [][]byte) error {
+// Scrubs messages before they're queued so that sensitive content never
+// makes it into a stored line or any of the secondary indexes.
+func (r *Receiver) redact(messages []*LogMessage) {
+	for _, message := range messages {
+		r.redactor.Redact(message)
+	}
+}
+
+// Applies a conf's sampling and rate limiting policies to a group of lines
+// that are about to be stored.
+func (r *Receiver) shouldStore(conf *IndexConf, value string, lines [][]byte) bool {
+	if !sampleValue(conf, value) &&
+		(len(conf.alwaysKeep) == 0 ||
+			!r.keepUnsampled(conf, value, alwaysKept(conf, lines))) {
+		printVerbose("drop_group key=%v value=%v reason=sampled\n",
+			conf.key, value)
+		return false
+	}
+
+	if conf.rateLimit > 0 &&
+		!r.limiter.Allow(buildKey(conf.key, value), len(lines), conf.rateLimit) {
+		printVerbose("drop_group key=%v value=%v reason=rate_limited\n",
+			conf.key, value)
+		return false
+	}
+
+	return true
+}
+
+// Gives back the rate limit used by lines that couldn't be written.
+func (r *Receiver) refundRateLimit(conf *IndexConf, value string, lines [][]byte) {
+	if conf.rateLimit > 0 {
+		r.limiter.Refund(buildKey(conf.key, value), len(lines))
+	}
+}
+
+// Finds the value that a message should be indexed under for a given conf,
+// preferring a parsed pair and falling back to the conf's extractor.
+func indexValue(conf *IndexConf, message *LogMessage) (string, bool) {
+	if value, ok := message.pairs[conf.key]; ok {
+		return value, true
+	}
+
+	if conf.extractor != nil {
+		return conf.extractor.Extract(message.data)
+	}
+
+	return "", false
+}
+
+// Splits a raw value into the identifiers that it contains according to
+// the conf's separator, then normalizes each one and discards any that
+// aren't valid. These identifiers will become part of Redis keys, so it's
+// worth being strict about them.
+func normalizeValues(conf *IndexConf, value string) []string {
+	var rawValues []string
+	if conf.separator == "" {
+		rawValues = []string{value}
+	} else {
+		rawValues = strings.Split(value, conf.separator)
+	}
+
+	values := make([]string, 0, len(rawValues))
+	for _, rawValue := range rawValues {
+		if conf.trimSpace {
+			rawValue = strings.TrimSpace(rawValue)
+		}
+
+		if conf.lowercase {
+			rawValue = strings.ToLower(rawValue)
+		}
+
+		if rawValue == "" {
+			continue
+		}
+
+		if conf.maxValueLength > 0 && len(rawValue) > conf.maxValueLength {
+			printVerbose("discard_value key=%v reason=too_long\n", conf.key)
+			continue
+		}
+
+		if conf.validValue != nil && !conf.validValue.MatchString(rawValue) {
+			printVerbose("discard_value key=%v reason=invalid\n", conf.key)
+			continue
+		}
+
+		values = append(values, rawValue)
+	}
+
+	return values
+}
+
+// Appends lines to a value's key. Returns the lines that were appended, which
+// leave out any past the conf's maxSize.
+func (r *Receiver) compress(conf *IndexConf, value string, lines [][]byte) ([][]byte, error) {
+	var appended [][]byte
 	var err error
 	// We use an optimistic locking strategy to set our compressed traces
 	// by assuming that another routing/process isn't trying to set the
 	// same value. On a locking failure, try again a number of times
 	// before giving up.
 	for i := 0; i < LockRetries; i++ {
-		ok, err := r.compressOptimistically(conf, value, lines)
+		var ok bool
+		appended, ok, err = r.compressOptimistically(conf, value, lines)
 		if err == nil && !ok {
+			atomic.AddInt64(&r.conflicts, 1)
+
 			// sleep for a random small amount of time to help avoid
 			// contention problems with other parallel processes that are
 			// also trying to push data to this key
@@ -95,10 +284,10 @@ func (r *Receiver) compress(conf *IndexConf, value string, lines [][]byte) error
 		}
 		break
 	}
-	return err
+	return appended, err
 }
 
-func (r *Receiver) compressOptimistically(conf *IndexConf, value string, lines [][]byte) (bool, error) {
+func (r *Receiver) compressOptimistically(conf *IndexConf, value string, lines [][]byte) ([][]byte, bool, error) {
 	conn := r.connPool.Get()
 	defer conn.Close()
 
@@ -108,60 +297,203 @@ func (r *Receiver) compressOptimistically(conf *IndexConf, value string, lines [
 
 	compressed, err := conn.Do("GET", key)
 	if err != nil {
-		return true, err
+		return nil, true, err
+	}
+
+	currentTTL, err := redis.Int(conn.Do("TTL", key))
+	if err != nil {
+		return nil, true, err
 	}
 
 	var writeBuffer bytes.Buffer
-	writer := gzip.NewWriter(&writeBuffer)
-	defer writer.Close()
+	existingLines := 0
 
 	// read in whatever we already have compressed and write it out to
 	// the our write buffer
 	if compressed != nil {
-		reader, err := gzip.NewReader(bytes.NewBuffer(compressed.([]byte)))
+		decrypted, err := r.encryptor.Decrypt(key, compressed.([]byte))
 		if err != nil {
-			return true, err
+			return nil, true, err
+		}
+
+		existing, err := decodeBlob(decrypted)
+		if err != nil {
+			return nil, true, err
+		}
+
+		data, err := existing.Decompress()
+		if err != nil {
+			return nil, true, err
+		}
+		writeBuffer.Write(data)
+		existingLines = bytes.Count(data, []byte("\n"))
+	}
+
+	// keys hold at most maxSize lines, and lines past that are dropped so
+	// that a trace's beginning (and cursors into it) never change
+	appended := lines
+	if conf.maxSize > 0 && existingLines+len(lines) > conf.maxSize {
+		room := conf.maxSize - existingLines
+		if room < 0 {
+			room = 0
 		}
-		defer reader.Close()
-		io.Copy(writer, reader)
+		appended = lines[0:room]
+	}
+	dropped := len(lines) - len(appended)
+
+	for _, line := range appended {
+		writeBuffer.Write(line)
+		writeBuffer.Write([]byte("\n"))
 	}
 
-	for _, line := range lines {
-		writer.Write(line)
-		writer.Write([]byte("\n"))
+	// the first time that lines are dropped, a marker is written after the
+	// last line kept so that readers (like tail clients) can tell that the
+	// key stopped growing; it takes the key one line past maxSize, which is
+	// how later writes know that it's already there
+	truncated := dropped > 0 && existingLines <= conf.maxSize
+	if truncated {
+		writeBuffer.WriteString(fmt.Sprintf(TruncatedMarker, conf.maxSize))
+		writeBuffer.Write([]byte("\n"))
+	}
+
+	// existing content is recompressed with the conf's codec, so changing a
+	// conf's codec migrates its keys as they're written to
+	var blob []byte
+	if len(appended) > 0 || truncated {
+		codec := confCodec(conf)
+		data, err := codec.Compress(writeBuffer.Bytes())
+		if err != nil {
+			return nil, true, err
+		}
+
+		blob, err = r.encryptor.Encrypt(key, encodeBlob(&Blob{Codec: codec, Data: data}))
+		if err != nil {
+			return nil, true, err
+		}
 	}
 
 	conn.Send("MULTI")
 
 	// store in the compressed fragments
-	writer.Close()
-	conn.Send("SET", key, &writeBuffer)
+	if blob != nil {
+		conn.Send("SET", key, blob)
+	}
 
-	// bump the key's TTL now that it has a new entry
-	conn.Send("EXPIRE", key, int(conf.ttl))
+	// bump the key's TTL now that it has a new entry, extending it to a
+	// longer retention if the entry was interesting (like an error). Lines
+	// dropped because the key is full count too, because traces that end in
+	// an error are the ones most likely to have filled up.
+	interesting := isInteresting(conf, lines)
+	if ttl := retentionTTL(conf, interesting, currentTTL); ttl > 0 {
+		conn.Send("EXPIRE", key, ttl)
+	}
+
+	if interesting && conf.feedMax > 0 {
+		feedKey := buildFeedKey(conf.key)
+		conn.Send("ZADD", feedKey, time.Now().Unix(), value)
+		conn.Send("ZREMRANGEBYRANK", feedKey, 0, -(conf.feedMax + 1))
+		conn.Send("EXPIRE", feedKey, int(conf.interestingTTL.Seconds()))
+	}
+
+	// counters are updated in the same transaction so that they're only
+	// counted once no matter how many times the write is retried
+	statsKey := buildStatsKey(conf.key)
+	conn.Send("HINCRBY", statsKey, StatsLinesWritten, len(appended))
+	if compressed == nil {
+		conn.Send("HINCRBY", statsKey, StatsKeysCreated, 1)
+	}
+	if dropped > 0 {
+		conn.Send("HINCRBY", statsKey, StatsLinesDropped, dropped)
+	}
+	if truncated {
+		conn.Send("HINCRBY", statsKey, StatsKeysTruncated, 1)
+	}
 
 	res, err := conn.Do("EXEC")
 	// if the WATCH failed, then EXEC will return nil instead of
 	// individual execution results
 	if res == nil {
-		return false, nil
+		return nil, false, nil
 	}
-	return true, err
+	return appended, true, err
 }
 
-func (r *Receiver) handleMessage() {
-	for messages := range r.MessagesChan {
-		for conf, confGroups := range r.buildGroups(messages) {
-			for value, lines := range confGroups {
-				printVerbose("handle_group key=%v value=%v size=%v\n",
-					conf.key, value, len(lines))
+// Gets the number of shard workers that are currently running.
+func (r *Receiver) Workers() int {
+	return int(atomic.LoadInt32(&r.workers))
+}
 
-				err := r.compress(conf, value, lines)
-				if err != nil {
-					fmt.Fprintf(os.Stderr,
-						"Couldn't compress message to Redis: %s\n", err.Error())
-				}
+// Gets the number of shard workers currently writing to Redis.
+func (r *Receiver) Writing() int {
+	return int(atomic.LoadInt32(&r.writing))
+}
+
+// Writes each group of lines to its key along with the secondary indexes,
+// subject to sampling and rate limiting. Returns the number of groups that
+// couldn't be written.
+func (r *Receiver) storeGroups(groups StorageGroup) int {
+	failed := 0
+	for conf, confGroups := range groups {
+		for value, lines := range confGroups {
+			if !r.handleGroup(conf, value, lines) {
+				failed++
 			}
 		}
 	}
+	return failed
+}
+
+// Writes a group of lines unless it's sampled out or rate limited. Returns
+// false only if the lines should have been written but couldn't be.
+func (r *Receiver) handleGroup(conf *IndexConf, value string, lines [][]byte) bool {
+	if !r.shouldStore(conf, value, lines) {
+		return true
+	}
+	return r.storeGroup(conf, value, lines)
+}
+
+// Writes a group of lines to its key along with the secondary indexes.
+// Returns false if the lines couldn't be written.
+func (r *Receiver) storeGroup(conf *IndexConf, value string, lines [][]byte) bool {
+	printVerbose("handle_group key=%v value=%v size=%v\n",
+		conf.key, value, len(lines))
+
+	if !r.breaker.Allow() {
+		printVerbose("drop_group key=%v value=%v reason=circuit_open\n",
+			conf.key, value)
+		r.refundRateLimit(conf, value, lines)
+		return false
+	}
+
+	start := time.Now()
+	appended, err := r.compress(conf, value, lines)
+	r.recordLatency(time.Since(start))
+
+	// errors decoding what's already stored don't trip the breaker, or a
+	// retired encryption key would fail every drain while Redis is fine
+	if redisUnavailable(err) {
+		r.breaker.Record(err)
+	} else {
+		r.breaker.Record(nil)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr,
+			"Couldn't compress message to Redis: %s\n", err.Error())
+		r.refundRateLimit(conf, value, lines)
+		return false
+	}
+
+	// lines dropped because the key is full aren't indexed
+	err = r.recordRecent(conf, value, appended)
+	if err != nil {
+		fmt.Fprintf(os.Stderr,
+			"Couldn't record recent key to Redis: %s\n", err.Error())
+	}
+
+	err = r.recordSearch(conf, value, appended)
+	if err != nil {
+		fmt.Fprintf(os.Stderr,
+			"Couldn't record search tokens to Redis: %s\n", err.Error())
+	}
+	return true
 }
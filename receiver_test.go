@@ -3,8 +3,12 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
+	"fmt"
 	"io/ioutil"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 )
@@ -19,21 +23,21 @@ func TestBuildGroups(t *testing.T) {
 			data: []byte("request_id=req1 line=1"),
 			pairs: map[string]string{
 				"request_id": "req1",
-				"line": "1",
+				"line":       "1",
 			},
 		},
 		&LogMessage{
 			data: []byte("request_id=req1,req2 line=2"),
 			pairs: map[string]string{
 				"request_id": "req1,req2",
-				"line": "2",
+				"line":       "2",
 			},
 		},
 		&LogMessage{
 			data: []byte("request_id=req2 line=1"),
 			pairs: map[string]string{
 				"request_id": "req2",
-				"line": "1",
+				"line":       "1",
 			},
 		},
 	}
@@ -47,25 +51,343 @@ func TestBuildGroups(t *testing.T) {
 	if len(confGroup) != 2 {
 		t.Errorf("Expected conf group length %v, got %v\n", 2, len(confGroup))
 	}
-		
+
 	lines := confGroup["req1"]
 	if len(lines) != 2 {
 		t.Errorf("Expected req1 lines length %v, got %v\n", 2, len(lines))
 	}
-		
+
 	lines = confGroup["req2"]
 	if len(lines) != 2 {
 		t.Errorf("Expected req2 lines length %v, got %v\n", 2, len(lines))
 	}
 }
 
+func TestBuildGroupsExtractor(t *testing.T) {
+	extractorConf := &IndexConf{
+		extractor: NewRegexExtractor(
+			regexp.MustCompile(`request-id: (?P<value>\w+)`), "value"),
+		key:     "request_id",
+		maxSize: 2,
+		ttl:     1 * time.Hour,
+	}
+
+	subject := NewReceiver([]*IndexConf{extractorConf}, connPool)
+
+	messages := []*LogMessage{
+		&LogMessage{
+			data:  []byte("GET /apps request-id: req1"),
+			pairs: map[string]string{},
+		},
+		&LogMessage{
+			data: []byte("request_id=req2 line=1"),
+			pairs: map[string]string{
+				"request_id": "req2",
+				"line":       "1",
+			},
+		},
+		&LogMessage{
+			data:  []byte("GET /apps"),
+			pairs: map[string]string{},
+		},
+	}
+
+	confGroup := subject.buildGroups(messages)[extractorConf]
+	if len(confGroup) != 2 {
+		t.Errorf("Expected conf group length %v, got %v\n", 2, len(confGroup))
+	}
+
+	lines := confGroup["req1"]
+	if len(lines) != 1 {
+		t.Errorf("Expected req1 lines length %v, got %v\n", 1, len(lines))
+	}
+}
+
+func TestShouldStoreSampling(t *testing.T) {
+	setup(t)
+
+	sampleConf := &IndexConf{
+		alwaysKeep: parsePredicates("at=error"),
+		key:        "request_id",
+		maxSize:    2,
+		rateLimit:  2,
+		sampleRate: 0.0001,
+		ttl:        1 * time.Hour,
+	}
+
+	subject := NewReceiver([]*IndexConf{sampleConf}, connPool)
+
+	messages := []*LogMessage{
+		&LogMessage{
+			data: []byte("request_id=req1 at=info"),
+			pairs: map[string]string{
+				"request_id": "req1",
+				"at":         "info",
+			},
+		},
+		&LogMessage{
+			data: []byte("request_id=req1 at=error"),
+			pairs: map[string]string{
+				"request_id": "req1",
+				"at":         "error",
+			},
+		},
+		&LogMessage{
+			data: []byte("request_id=req2 at=info"),
+			pairs: map[string]string{
+				"request_id": "req2",
+				"at":         "info",
+			},
+		},
+	}
+
+	confGroup := keptGroups(subject, messages)[sampleConf]
+	if len(confGroup) != 1 {
+		t.Errorf("Expected conf group length %v, got %v\n", 1, len(confGroup))
+	}
+
+	lines := confGroup["req1"]
+	if len(lines) != 2 {
+		t.Errorf("Expected req1 lines length %v, got %v\n", 2, len(lines))
+	}
+
+	// req1 has now used up its rate limit
+	confGroup = keptGroups(subject, messages)[sampleConf]
+	if len(confGroup) != 0 {
+		t.Errorf("Expected conf group length %v, got %v\n", 0, len(confGroup))
+	}
+}
+
+func TestShouldStoreSamplingAcrossBatches(t *testing.T) {
+	setup(t)
+
+	sampleConf := &IndexConf{
+		alwaysKeep: parsePredicates("at=error"),
+		key:        "request_id",
+		maxSize:    2,
+		sampleRate: 0.0001,
+		ttl:        1 * time.Hour,
+	}
+
+	subject := NewReceiver([]*IndexConf{sampleConf}, connPool)
+
+	message := func(value, at string) []*LogMessage {
+		return []*LogMessage{
+			&LogMessage{
+				data:  []byte("request_id=" + value + " at=" + at),
+				pairs: map[string]string{"request_id": value, "at": at},
+			},
+		}
+	}
+
+	// req1 is dropped until it errors, and kept from its error onwards
+	if len(keptGroups(subject, message("req1", "info"))[sampleConf]) != 0 {
+		t.Errorf("Expected req1 to be sampled out\n")
+	}
+	if len(keptGroups(subject, message("req1", "error"))[sampleConf]) != 1 {
+		t.Errorf("Expected req1 to be kept from its error\n")
+	}
+	if len(keptGroups(subject, message("req1", "info"))[sampleConf]) != 1 {
+		t.Errorf("Expected req1 to still be kept after its error\n")
+	}
+
+	// another process learns about the decision through Redis
+	other := NewReceiver([]*IndexConf{sampleConf}, connPool)
+	if len(keptGroups(other, message("req1", "info"))[sampleConf]) != 1 {
+		t.Errorf("Expected req1 to be kept by another receiver\n")
+	}
+	if len(keptGroups(other, message("req2", "info"))[sampleConf]) != 0 {
+		t.Errorf("Expected req2 to be sampled out by another receiver\n")
+	}
+}
+
+// Groups messages and drops the groups that sampling or rate limiting
+// wouldn't store, like a shard does before writing them.
+func keptGroups(r *Receiver, messages []*LogMessage) StorageGroup {
+	groups := r.buildGroups(messages)
+	for conf, confGroups := range groups {
+		for value, lines := range confGroups {
+			if !r.shouldStore(conf, value, lines) {
+				delete(confGroups, value)
+			}
+		}
+	}
+	return groups
+}
+
+func TestRateLimitRefundedOnFailure(t *testing.T) {
+	setup(t)
+
+	limitConf := &IndexConf{
+		key:       "request_id",
+		maxSize:   2,
+		rateLimit: 1,
+		ttl:       1 * time.Hour,
+	}
+
+	subject := NewReceiver([]*IndexConf{limitConf}, connPool)
+	subject.breaker = NewCircuitBreaker(1, time.Hour)
+	subject.breaker.Record(fmt.Errorf("down"))
+
+	groups := subject.buildGroups([]*LogMessage{
+		&LogMessage{
+			data:  []byte("request_id=req1"),
+			pairs: map[string]string{"request_id": "req1"},
+		},
+	})
+	if subject.storeGroups(groups) != 1 {
+		t.Errorf("Expected the write to fail with the breaker open\n")
+	}
+
+	if !subject.limiter.Allow(buildKey("request_id", "req1"), 1, 1) {
+		t.Errorf("Expected the failed write's rate limit to be refunded\n")
+	}
+}
+
+func TestRedactionNeverStored(t *testing.T) {
+	setup(t)
+
+	redactConf := &IndexConf{
+		key:        "request_id",
+		maxSize:    2,
+		recentMax:  10,
+		recentTags: []string{"email"},
+		searchMax:  10,
+		ttl:        1 * time.Hour,
+	}
+
+	subject := NewReceiver([]*IndexConf{redactConf}, connPool)
+	subject.redactor = newTestRedactor()
+
+	messages := readLogplex(strings.NewReader(
+		"86 <158>1 2015-01-01T00:00:00+00:00 host app web.1 - "+
+			"request_id=req1 password=hunter2\n"+
+			"89 <158>1 2015-01-01T00:00:00+00:00 host app web.1 - "+
+			"request_id=req1 email=a@b.io token=t\n"),
+		parsers["logfmt"])
+	subject.redact(messages)
+
+	for conf, confGroups := range subject.buildGroups(messages) {
+		for value, lines := range confGroups {
+			if _, err := subject.compress(conf, value, lines); err != nil {
+				t.Error(err)
+			}
+			if err := subject.recordRecent(conf, value, lines); err != nil {
+				t.Error(err)
+			}
+			if err := subject.recordSearch(conf, value, lines); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+
+	conn := connPool.Get()
+	defer conn.Close()
+
+	// check every key and value in the store for anything sensitive
+	keys, err := redis.Strings(conn.Do("KEYS", "*"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	stored := make([]string, 0)
+	for _, key := range keys {
+		stored = append(stored, key)
+
+		keyType, err := redis.String(conn.Do("TYPE", key))
+		if err != nil {
+			t.Error(err)
+		}
+
+		if keyType == "zset" {
+			members, err := redis.Strings(conn.Do("ZRANGE", key, 0, -1))
+			if err != nil {
+				t.Error(err)
+			}
+			stored = append(stored, members...)
+			continue
+		}
+
+		if keyType == "hash" {
+			pairs, err := redis.Strings(conn.Do("HGETALL", key))
+			if err != nil {
+				t.Error(err)
+			}
+			stored = append(stored, pairs...)
+			continue
+		}
+
+		compressed, err := redis.Bytes(conn.Do("GET", key))
+		if err != nil {
+			t.Error(err)
+		}
+
+		blob, err := decodeBlob(compressed)
+		if err != nil {
+			t.Error(err)
+		}
+
+		lines, err := readLines(blob)
+		if err != nil {
+			t.Error(err)
+		}
+		for _, line := range lines {
+			stored = append(stored, string(line))
+		}
+	}
+
+	if len(stored) < 2 {
+		t.Errorf("Expected stored content, got %v\n", stored)
+	}
+	for _, s := range stored {
+		for _, secret := range []string{"hunter2", "a@b.io", "token=t"} {
+			if strings.Contains(s, secret) {
+				t.Errorf("Expected '%v' not to be stored, found in '%v'\n", secret, s)
+			}
+		}
+	}
+}
+
+func TestNormalizeValues(t *testing.T) {
+	normalizeConf := &IndexConf{
+		key:            "user",
+		lowercase:      true,
+		maxValueLength: 8,
+		trimSpace:      true,
+		validValue:     regexp.MustCompile(`^[a-z0-9@.]+$`),
+	}
+
+	values := normalizeValues(normalizeConf, " A@B.io ")
+	if len(values) != 1 || values[0] != "a@b.io" {
+		t.Errorf("Expected values %v, got %v\n", []string{"a@b.io"}, values)
+	}
+
+	// no separator is configured, so commas are part of the value and
+	// invalid
+	values = normalizeValues(normalizeConf, "a,b")
+	if len(values) != 0 {
+		t.Errorf("Expected no values, got %v\n", values)
+	}
+
+	values = normalizeValues(normalizeConf, "abcdefghi")
+	if len(values) != 0 {
+		t.Errorf("Expected no values, got %v\n", values)
+	}
+
+	normalizeConf.separator = ";"
+	values = normalizeValues(normalizeConf, "a; b;;")
+	if len(values) != 2 || values[0] != "a" || values[1] != "b" {
+		t.Errorf("Expected values %v, got %v\n", []string{"a", "b"}, values)
+	}
+}
+
 func TestMessageCompression(t *testing.T) {
 	setup(t)
 
 	subject := NewReceiver([]*IndexConf{conf}, connPool)
 
 	line := "request_id=req1"
-	err := subject.compress(conf, "req1", [][]byte{[]byte(line)})
+	_, err := subject.compress(conf, "req1", [][]byte{[]byte(line)})
 	if err != nil {
 		t.Error(err)
 	}
@@ -102,8 +424,9 @@ func TestMessageCompression(t *testing.T) {
 		t.Error(err)
 	}
 
-	if ttl < (int(conf.ttl)-10) || ttl > int(conf.ttl) {
-		t.Errorf("Expected ttl %v, got %v\n", int(conf.ttl), ttl)
+	expectedTTL := int(conf.ttl.Seconds())
+	if ttl < (expectedTTL-10) || ttl > expectedTTL {
+		t.Errorf("Expected ttl %v, got %v\n", expectedTTL, ttl)
 	}
 }
 
@@ -132,7 +455,7 @@ func TestMessageCompressionIncrement(t *testing.T) {
 		t.Error(err)
 	}
 
-	err = subject.compress(conf, "req1", [][]byte{[]byte(line + " line=2")})
+	_, err = subject.compress(conf, "req1", [][]byte{[]byte(line + " line=2")})
 	if err != nil {
 		t.Error(err)
 	}
@@ -160,6 +483,101 @@ func TestMessageCompressionIncrement(t *testing.T) {
 	}
 }
 
+func TestMessageCompressionCodec(t *testing.T) {
+	setup(t)
+
+	subject := NewReceiver([]*IndexConf{conf}, connPool)
+	retriever := NewRetriever([]*IndexConf{conf}, connPool)
+
+	// written as gzip first, then migrated to zstd on the next write
+	line := "request_id=req1"
+	_, err := subject.compress(conf, "req1", [][]byte{[]byte(line + " line=1")})
+	if err != nil {
+		t.Error(err)
+	}
+
+	zstdConf := *conf
+	zstdConf.codec = codecs["zstd"]
+	_, err = subject.compress(&zstdConf, "req1", [][]byte{[]byte(line + " line=2")})
+	if err != nil {
+		t.Error(err)
+	}
+
+	blob, ok, err := retriever.Lookup("req1")
+	if err != nil {
+		t.Error(err)
+	}
+	if !ok {
+		t.Fatalf("Expected found true, got false\n")
+	}
+	if blob.Codec.Tag() != "zstd" {
+		t.Errorf("Expected codec %v, got %v\n", "zstd", blob.Codec.Tag())
+	}
+
+	b, err := blob.Decompress()
+	if err != nil {
+		t.Error(err)
+	}
+
+	actual := string(b)
+	expected := line + " line=1\n" + line + " line=2\n"
+	if expected != actual {
+		t.Errorf("Expected buffer '%v', got '%v'\n", expected, actual)
+	}
+}
+
+func TestStoreGroupIndexesAppendedLines(t *testing.T) {
+	setup(t)
+
+	fullConf := &IndexConf{
+		feedMax:        10,
+		interesting:    parsePredicates("at=error"),
+		interestingTTL: 2 * time.Hour,
+		key:            "request_id",
+		maxSize:        1,
+		recentMax:      10,
+		recentTags:     []string{"at"},
+		searchMax:      10,
+		ttl:            1 * time.Hour,
+	}
+
+	subject := NewReceiver([]*IndexConf{fullConf}, connPool)
+	ok := subject.storeGroup(fullConf, "req1", [][]byte{
+		[]byte("request_id=req1 at=info"),
+		[]byte("request_id=req1 at=error"),
+	})
+	if !ok {
+		t.Fatalf("Expected the group to be stored\n")
+	}
+
+	conn := connPool.Get()
+	defer conn.Close()
+
+	// the error line was dropped, so it isn't indexed (but it still
+	// promotes the key; see TestInterestingRetentionWhenFull)
+	unexpected := []string{
+		buildRecentKey(fullConf.key, "at", "error"),
+		buildSearchKey(fullConf.key, "at=error"),
+	}
+	for _, key := range unexpected {
+		exists, err := redis.Bool(conn.Do("EXISTS", key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists {
+			t.Errorf("Expected %v not to exist for a dropped line\n", key)
+		}
+	}
+
+	exists, err := redis.Bool(conn.Do("EXISTS", buildSearchKey(fullConf.key, "at=info")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Errorf("Expected the appended line to be indexed\n")
+	}
+}
+
 func redisList(t *testing.T, conn redis.Conn, key string) []string {
 	results, err := redis.Values(conn.Do("LRANGE", key, 0, 1))
 	if err != nil {
@@ -174,3 +592,70 @@ func redisList(t *testing.T, conn redis.Conn, key string) []string {
 
 	return strings
 }
+
+func TestMessageTruncation(t *testing.T) {
+	setup(t)
+
+	receiver := NewReceiver([]*IndexConf{conf}, connPool)
+	retriever := NewRetriever([]*IndexConf{conf}, connPool)
+
+	writes := [][][]byte{
+		{[]byte("request_id=req1 n=1")},
+		{[]byte("request_id=req1 n=2"), []byte("request_id=req1 n=3")},
+		{[]byte("request_id=req1 n=4")},
+	}
+	appended := 0
+	for _, lines := range writes {
+		written, err := receiver.compress(conf, "req1", lines)
+		if err != nil {
+			t.Fatal(err)
+		}
+		appended += len(written)
+	}
+	if appended != conf.maxSize {
+		t.Errorf("Expected %v lines appended, got %v\n", conf.maxSize, appended)
+	}
+
+	blob, _, err := retriever.Lookup("req1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines, err := readLines(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != conf.maxSize+1 || string(lines[1]) != "request_id=req1 n=2" {
+		t.Errorf("Expected the first %v lines, got %q\n", conf.maxSize, lines)
+	}
+
+	// only one marker is written no matter how many lines are dropped
+	marker := fmt.Sprintf(TruncatedMarker, conf.maxSize)
+	if string(lines[len(lines)-1]) != marker {
+		t.Errorf("Expected last line %q, got %q\n", marker, lines[len(lines)-1])
+	}
+
+	conn := connPool.Get()
+	defer conn.Close()
+
+	counters, err := redis.Strings(conn.Do("HGETALL", buildStatsKey(conf.key)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		StatsKeysCreated:   "1",
+		StatsKeysTruncated: "1",
+		StatsLinesDropped:  "2",
+		StatsLinesWritten:  "2",
+	}
+	actual := make(map[string]string)
+	for i := 0; i+1 < len(counters); i += 2 {
+		actual[counters[i]] = counters[i+1]
+	}
+	for field, value := range expected {
+		if actual[field] != value {
+			t.Errorf("Expected %v %v, got %v\n", field, value, actual[field])
+		}
+	}
+}
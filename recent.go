@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	RecentDefaultLimit = 50
+	RecentMaxLimit     = 500
+)
+
+type RecentKey struct {
+	LastWrite time.Time `json:"last_write"`
+	Value     string    `json:"value"`
+}
+
+// Records that a value has just been written to for a conf that keeps a
+// recent keys index. The value is added to a sorted set scored by write time
+// along with one set for each tagged field value found in its lines so that
+// recent keys can later be filtered by them (e.g. `at=error`).
+func (r *Receiver) recordRecent(conf *IndexConf, value string, lines [][]byte) error {
+	if conf.recentMax <= 0 {
+		return nil
+	}
+
+	conn := r.connPool.Get()
+	defer conn.Close()
+
+	keys := append([]string{buildRecentKey(conf.key, "", "")},
+		recentTagKeys(conf, r.encryptor, lines)...)
+
+	now := time.Now().Unix()
+	conn.Send("MULTI")
+	for _, key := range keys {
+		conn.Send("ZADD", key, now, value)
+		// keep only the most recent entries
+		conn.Send("ZREMRANGEBYRANK", key, 0, -(conf.recentMax + 1))
+		conn.Send("EXPIRE", key, int(conf.ttl.Seconds()))
+	}
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// Finds the keys of the per-tag recent sets that a group of lines is
+// recorded in, one for each tagged field value found in them. Tag values are
+// hashed when encryption is enabled.
+func recentTagKeys(conf *IndexConf, encryptor *Encryptor, lines [][]byte) []string {
+	var keys []string
+	if len(conf.recentTags) == 0 {
+		return keys
+	}
+
+	seen := make(map[string]bool)
+	for _, line := range lines {
+		message := &LogMessage{data: line, pairs: make(map[string]string)}
+		parsers["auto"].Parse(message)
+
+		for _, tag := range conf.recentTags {
+			tagValue, ok := message.pairs[tag]
+			if !ok || tagValue == "" {
+				continue
+			}
+
+			key := buildRecentKey(conf.key, tag, encryptor.IndexToken(tagValue))
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+// Lists the values most recently written to for a conf, newest first.
+// Results can be restricted to values written to within `since` (if
+// non-zero) and to those whose lines contained all of the given tagged field
+// values.
+func (r *Retriever) Recent(conf *IndexConf, filters map[string]string,
+	since time.Duration, offset int, limit int) ([]*RecentKey, error) {
+
+	conn := r.connPool.Get()
+	defer conn.Close()
+
+	if limit <= 0 || limit > RecentMaxLimit {
+		limit = RecentDefaultLimit
+	}
+
+	key := buildRecentKey(conf.key, "", "")
+	if len(filters) > 0 {
+		tags := make([]string, 0, len(filters))
+		for tag := range filters {
+			tags = append(tags, tag)
+		}
+		sort.Strings(tags)
+
+		filterKeys := make([]interface{}, len(tags))
+		for i, tag := range tags {
+			filterKeys[i] = buildRecentKey(conf.key, tag, r.encryptor.IndexToken(filters[tag]))
+		}
+
+		if len(filterKeys) == 1 {
+			key = filterKeys[0].(string)
+		} else {
+			// intersect multiple filters into a temporary set that will
+			// clean itself up even if we don't get to it
+			key = fmt.Sprintf("%s-recent-tmp-%d", Prefix, rand.Int63())
+			args := append([]interface{}{key, len(filterKeys)}, filterKeys...)
+			args = append(args, "AGGREGATE", "MAX")
+
+			conn.Send("MULTI")
+			conn.Send("ZINTERSTORE", args...)
+			conn.Send("EXPIRE", key, 60)
+			if _, err := conn.Do("EXEC"); err != nil {
+				return nil, err
+			}
+			defer conn.Do("DEL", key)
+		}
+	}
+
+	return listRecent(conn, key, since, offset, limit)
+}
+
+// Lists the members of a sorted set scored by write time, newest first.
+func listRecent(conn redis.Conn, key string, since time.Duration, offset int,
+	limit int) ([]*RecentKey, error) {
+
+	min := "-inf"
+	if since > 0 {
+		min = strconv.FormatInt(time.Now().Add(-since).Unix(), 10)
+	}
+
+	values, err := redis.Strings(conn.Do("ZREVRANGEBYSCORE", key, "+inf", min,
+		"WITHSCORES", "LIMIT", offset, limit))
+	if err != nil {
+		return nil, err
+	}
+
+	recent := make([]*RecentKey, 0, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		score, err := strconv.ParseFloat(values[i+1], 64)
+		if err != nil {
+			return nil, err
+		}
+
+		recent = append(recent, &RecentKey{
+			LastWrite: time.Unix(int64(score), 0).UTC(),
+			Value:     values[i],
+		})
+	}
+
+	return recent, nil
+}
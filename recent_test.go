@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecent(t *testing.T) {
+	setup(t)
+
+	recentConf := &IndexConf{
+		key:        "request_id",
+		maxSize:    2,
+		recentMax:  3,
+		recentTags: []string{"at", "status"},
+		ttl:        1 * time.Hour,
+	}
+
+	receiver := NewReceiver([]*IndexConf{recentConf}, connPool)
+	retriever := NewRetriever([]*IndexConf{recentConf}, connPool)
+
+	writes := []struct {
+		value string
+		line  string
+	}{
+		{"req1", "request_id=req1 at=error status=500"},
+		{"req2", "request_id=req2 at=info status=200"},
+		{"req3", "request_id=req3 at=error status=503"},
+		{"req4", "request_id=req4 at=error status=500"},
+	}
+	for _, write := range writes {
+		err := receiver.recordRecent(recentConf, write.value,
+			[][]byte{[]byte(write.line)})
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	// capped at recentMax
+	recent, err := retriever.Recent(recentConf, nil, 0, 0, 0)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(recent) != 3 {
+		t.Errorf("Expected recent length %v, got %v\n", 3, len(recent))
+	}
+
+	recent, err = retriever.Recent(recentConf, map[string]string{"at": "error"},
+		10*time.Minute, 0, 1)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(recent) != 1 {
+		t.Errorf("Expected recent length %v, got %v\n", 1, len(recent))
+	}
+
+	recent, err = retriever.Recent(recentConf,
+		map[string]string{"at": "error", "status": "500"}, 0, 0, 0)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(recent) != 2 {
+		t.Fatalf("Expected recent length %v, got %v\n", 2, len(recent))
+	}
+	for _, key := range recent {
+		if key.Value != "req1" && key.Value != "req4" {
+			t.Errorf("Expected value req1 or req4, got %v\n", key.Value)
+		}
+	}
+}
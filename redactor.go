@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+const (
+	RedactedValue = "[REDACTED]"
+)
+
+// RedactPattern masks anything that it matches, unless the match is
+// rejected by its validator.
+type RedactPattern struct {
+	pattern *regexp.Regexp
+
+	// Optional.
+	valid func(match []byte) bool
+}
+
+// Redactor scrubs sensitive content out of messages before they're stored.
+// Pairs with certain keys can be dropped entirely, have their values masked,
+// or have their values replaced by a keyed hash (so that they can still be
+// correlated without being revealed). Anything matching one of its patterns
+// is masked wherever it appears in a line, except in the values of kept keys
+// (the keys that messages are indexed under).
+type Redactor struct {
+	dropKeys map[string]bool
+	hashKey  []byte
+	hashKeys map[string]bool
+	keepKeys map[string]bool
+	maskKeys map[string]bool
+	patterns []*RedactPattern
+
+	// match `key=value` pairs for keys that need to be rewritten, or left
+	// alone, in logfmt messages
+	keepPattern *regexp.Regexp
+	pairPattern *regexp.Regexp
+}
+
+func NewRedactor(dropKeys []string, maskKeys []string, hashKeys []string,
+	keepKeys []string, patterns []*RedactPattern, hashKey []byte) *Redactor {
+
+	r := &Redactor{
+		dropKeys: toSet(dropKeys),
+		hashKey:  hashKey,
+		hashKeys: toSet(hashKeys),
+		keepKeys: toSet(keepKeys),
+		maskKeys: toSet(maskKeys),
+		patterns: patterns,
+	}
+
+	r.pairPattern = buildPairPattern(r.dropKeys, r.hashKeys, r.maskKeys)
+	r.keepPattern = buildPairPattern(r.keepKeys)
+
+	return r
+}
+
+// Builds a pattern matching logfmt pairs with any of the given keys, or nil
+// if there aren't any.
+func buildPairPattern(sets ...map[string]bool) *regexp.Regexp {
+	keys := make([]string, 0)
+	for _, set := range sets {
+		for key := range set {
+			keys = append(keys, regexp.QuoteMeta(key))
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	return regexp.MustCompile(`(^|\s)(` + strings.Join(keys, "|") +
+		`)=("(?:[^"\\]|\\.)*"|\S*)`)
+}
+
+// Checks a card number's check digit, ignoring separators.
+func luhnValid(match []byte) bool {
+	sum := 0
+	double := false
+	for i := len(match) - 1; i >= 0; i-- {
+		if match[i] < '0' || match[i] > '9' {
+			continue
+		}
+
+		digit := int(match[i] - '0')
+		if double {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// Redacts a message's data and pairs in place.
+func (r *Redactor) Redact(message *LogMessage) {
+	if r == nil {
+		return
+	}
+
+	if len(message.data) > 0 && message.data[0] == '{' {
+		if r.redactJSON(message) {
+			r.redactPairs(message)
+			return
+		}
+	}
+
+	if r.pairPattern != nil {
+		message.data = r.pairPattern.ReplaceAllFunc(message.data, func(match []byte) []byte {
+			submatches := r.pairPattern.FindSubmatch(match)
+			prefix, key, value := submatches[1], string(submatches[2]), submatches[3]
+
+			// the preceding whitespace goes with a dropped pair
+			if r.dropKeys[key] {
+				return []byte{}
+			}
+
+			replaced := r.redactValue(key, string(unquoteLogfmt(value)))
+			return []byte(string(prefix) + key + "=" + replaced)
+		})
+		message.data = bytes.TrimSpace(message.data)
+	}
+
+	message.data, _ = r.maskPatterns(message.data, r.keepPattern)
+
+	r.redactPairs(message)
+}
+
+// Masks matches of the redactor's patterns, except for those overlapping a
+// match of keep. Returns whether anything was masked.
+func (r *Redactor) maskPatterns(data []byte, keep *regexp.Regexp) ([]byte, bool) {
+	masked := false
+	for _, p := range r.patterns {
+		var kept [][]int
+		if keep != nil {
+			kept = keep.FindAllIndex(data, -1)
+		}
+
+		var out bytes.Buffer
+		last := 0
+		for _, match := range p.pattern.FindAllIndex(data, -1) {
+			if overlapsAny(match, kept) {
+				continue
+			}
+			if p.valid != nil && !p.valid(data[match[0]:match[1]]) {
+				continue
+			}
+
+			out.Write(data[last:match[0]])
+			out.WriteString(RedactedValue)
+			last = match[1]
+			masked = true
+		}
+
+		if last > 0 {
+			out.Write(data[last:])
+			data = out.Bytes()
+		}
+	}
+	return data, masked
+}
+
+func overlapsAny(span []int, others [][]int) bool {
+	for _, other := range others {
+		if span[0] < other[1] && other[0] < span[1] {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Redactor) hash(value string) string {
+	mac := hmac.New(sha256.New, r.hashKey)
+	mac.Write([]byte(value))
+	return "sha256:" + hex.EncodeToString(mac.Sum(nil))[0:16]
+}
+
+// Decodes a JSON message, redacts it, and encodes it again if anything was
+// redacted. Messages with nothing to redact are left byte for byte as they
+// were. Returns false if the message couldn't be decoded as JSON.
+func (r *Redactor) redactJSON(message *LogMessage) bool {
+	decoder := json.NewDecoder(bytes.NewReader(message.data))
+	decoder.UseNumber()
+
+	var object map[string]interface{}
+	if err := decoder.Decode(&object); err != nil {
+		return false
+	}
+
+	redacted, changed := r.redactJSONValue("", object)
+	if !changed {
+		return true
+	}
+
+	var data bytes.Buffer
+	encoder := json.NewEncoder(&data)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(redacted); err != nil {
+		return false
+	}
+
+	message.data = bytes.TrimSpace(data.Bytes())
+	return true
+}
+
+// Redacts a decoded JSON value in place. Returns whether anything changed.
+func (r *Redactor) redactJSONValue(key string, value interface{}) (interface{}, bool) {
+	if r.keepKeys[key] {
+		return value, false
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		changed := false
+		for subKey, subValue := range v {
+			if r.dropKeys[subKey] {
+				delete(v, subKey)
+				changed = true
+				continue
+			}
+
+			var subChanged bool
+			v[subKey], subChanged = r.redactJSONValue(subKey, subValue)
+			changed = changed || subChanged
+		}
+		return v, changed
+	case []interface{}:
+		changed := false
+		for i, subValue := range v {
+			var subChanged bool
+			v[i], subChanged = r.redactJSONValue(key, subValue)
+			changed = changed || subChanged
+		}
+		return v, changed
+	case string:
+		redacted := r.redactValue(key, v)
+		return redacted, redacted != v
+	default:
+		if r.hashKeys[key] || r.maskKeys[key] {
+			return r.redactValue(key, jsonScalar(v)), true
+		}
+		return v, false
+	}
+}
+
+// Brings a message's pairs in line with its redacted data. Pair keys may be
+// dotted paths produced by the JSON parser, in which case the last segment
+// is checked.
+func (r *Redactor) redactPairs(message *LogMessage) {
+	for key, value := range message.pairs {
+		leafKey := key
+		if i := strings.LastIndex(key, "."); i >= 0 {
+			leafKey = key[i+1:]
+		}
+
+		if r.dropKeys[key] || r.dropKeys[leafKey] {
+			delete(message.pairs, key)
+			continue
+		}
+
+		if r.keepKeys[key] {
+			continue
+		}
+
+		redactKey := key
+		if !r.hashKeys[key] && !r.maskKeys[key] {
+			redactKey = leafKey
+		}
+		message.pairs[key] = r.redactValue(redactKey, value)
+	}
+}
+
+func (r *Redactor) redactValue(key string, value string) string {
+	if r.hashKeys[key] {
+		return r.hash(value)
+	}
+
+	if r.maskKeys[key] {
+		return RedactedValue
+	}
+
+	masked, _ := r.maskPatterns([]byte(value), nil)
+	return string(masked)
+}
+
+func toSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		if value != "" {
+			set[value] = true
+		}
+	}
+	return set
+}
+
+// Strips the quotes and escapes off of a quoted logfmt value.
+func unquoteLogfmt(value []byte) []byte {
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return value
+	}
+
+	var unquoted string
+	if err := json.Unmarshal(value, &unquoted); err != nil {
+		return value[1 : len(value)-1]
+	}
+	return []byte(unquoted)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func newTestRedactor() *Redactor {
+	return NewRedactor(
+		[]string{"password"},
+		[]string{"token"},
+		[]string{"email"},
+		[]string{"request_id"},
+		[]*RedactPattern{
+			{pattern: regexp.MustCompile(`\d{4}-\d{4}-\d{4}-\d{4}`)},
+		},
+		[]byte("secret"))
+}
+
+func TestRedactLogfmt(t *testing.T) {
+	redactor := newTestRedactor()
+
+	message := &LogMessage{
+		data: []byte(`request_id=req1 password="hunter 2" token=abc ` +
+			`email=a@b.io msg="card 4242-4242-4242-4242"`),
+		pairs: make(map[string]string),
+	}
+	parsers["logfmt"].Parse(message)
+
+	redactor.Redact(message)
+
+	hash := redactor.hash("a@b.io")
+	expected := `request_id=req1 token=[REDACTED] email=` + hash +
+		` msg="card [REDACTED]"`
+	if expected != string(message.data) {
+		t.Errorf("Expected data '%v', got '%v'\n", expected, string(message.data))
+	}
+
+	if _, ok := message.pairs["password"]; ok {
+		t.Errorf("Expected password pair to be dropped\n")
+	}
+	if message.pairs["token"] != RedactedValue {
+		t.Errorf("Expected token %v, got %v\n", RedactedValue, message.pairs["token"])
+	}
+	if message.pairs["email"] != hash {
+		t.Errorf("Expected email %v, got %v\n", hash, message.pairs["email"])
+	}
+	if message.pairs["msg"] != "card "+RedactedValue {
+		t.Errorf("Expected msg %v, got %v\n", "card "+RedactedValue,
+			message.pairs["msg"])
+	}
+}
+
+func TestRedactJSON(t *testing.T) {
+	redactor := newTestRedactor()
+
+	message := &LogMessage{
+		data: []byte(`{"request_id":"req1","user":{"password":"hunter2",` +
+			`"email":"a@b.io","token":1234},"msg":"card 4242-4242-4242-4242"}`),
+		pairs: make(map[string]string),
+	}
+	parsers["json"].Parse(message)
+
+	redactor.Redact(message)
+
+	data := string(message.data)
+	for _, secret := range []string{"hunter2", "a@b.io", "1234", "password"} {
+		if strings.Contains(data, secret) {
+			t.Errorf("Expected '%v' to be redacted from '%v'\n", secret, data)
+		}
+	}
+
+	if _, ok := message.pairs["user.password"]; ok {
+		t.Errorf("Expected user.password pair to be dropped\n")
+	}
+	if message.pairs["user.email"] != redactor.hash("a@b.io") {
+		t.Errorf("Expected user.email to be hashed, got %v\n",
+			message.pairs["user.email"])
+	}
+	if message.pairs["user.token"] != RedactedValue {
+		t.Errorf("Expected user.token %v, got %v\n", RedactedValue,
+			message.pairs["user.token"])
+	}
+	if message.pairs["request_id"] != "req1" {
+		t.Errorf("Expected request_id %v, got %v\n", "req1",
+			message.pairs["request_id"])
+	}
+}
+
+func TestRedactCardNumbers(t *testing.T) {
+	redactor := NewRedactor(nil, nil, nil, []string{"request_id"}, redactPatterns, nil)
+
+	// 4242 4242 4242 4242 passes the Luhn check, and 1700000000123 (a
+	// millisecond timestamp) doesn't
+	message := &LogMessage{
+		data:  []byte("card=4242-4242-4242-4242 at=1700000000123"),
+		pairs: make(map[string]string),
+	}
+	parsers["logfmt"].Parse(message)
+	redactor.Redact(message)
+
+	expected := "card=" + RedactedValue + " at=1700000000123"
+	if expected != string(message.data) {
+		t.Errorf("Expected data '%v', got '%v'\n", expected, string(message.data))
+	}
+	if message.pairs["at"] != "1700000000123" {
+		t.Errorf("Expected at %v, got %v\n", "1700000000123", message.pairs["at"])
+	}
+
+	// index values are never redacted, even when they look like cards
+	message = &LogMessage{
+		data:  []byte("request_id=4242424242424242 card=4242424242424242"),
+		pairs: make(map[string]string),
+	}
+	parsers["logfmt"].Parse(message)
+	redactor.Redact(message)
+
+	expected = "request_id=4242424242424242 card=" + RedactedValue
+	if expected != string(message.data) {
+		t.Errorf("Expected data '%v', got '%v'\n", expected, string(message.data))
+	}
+	if message.pairs["request_id"] != "4242424242424242" {
+		t.Errorf("Expected request_id %v, got %v\n", "4242424242424242",
+			message.pairs["request_id"])
+	}
+}
+
+func TestRedactJSONUnchanged(t *testing.T) {
+	redactor := newTestRedactor()
+
+	data := `{"request_id":"req1","msg":"<b>a & b</b>","at":"info"}`
+	message := &LogMessage{
+		data:  []byte(data),
+		pairs: make(map[string]string),
+	}
+	parsers["json"].Parse(message)
+	redactor.Redact(message)
+
+	if string(message.data) != data {
+		t.Errorf("Expected data '%v', got '%v'\n", data, string(message.data))
+	}
+}
+
+func TestConfiguredRedactorNeedsHashKey(t *testing.T) {
+	os.Setenv("REDACT_HASH_KEYS", "email")
+	defer os.Unsetenv("REDACT_HASH_KEYS")
+
+	if _, err := configuredRedactor(); err == nil {
+		t.Errorf("Expected an error for hash keys without REDACT_HASH_KEY\n")
+	}
+
+	os.Setenv("REDACT_HASH_KEY", "secret")
+	defer os.Unsetenv("REDACT_HASH_KEY")
+
+	if _, err := configuredRedactor(); err != nil {
+		t.Errorf("Expected no error, got %v\n", err)
+	}
+}
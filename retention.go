@@ -0,0 +1,60 @@
+package main
+
+import (
+	"time"
+)
+
+// Checks whether any of a group of lines match one of a conf's interesting
+// predicates, meaning that its key should be kept for the conf's longer
+// interestingTTL.
+func isInteresting(conf *IndexConf, lines [][]byte) bool {
+	if len(conf.interesting) == 0 {
+		return false
+	}
+
+	for _, line := range lines {
+		message := &LogMessage{data: line, pairs: make(map[string]string)}
+		parsers["auto"].Parse(message)
+
+		if matchesAny(conf.interesting, message) {
+			return true
+		}
+	}
+	return false
+}
+
+// Chooses the TTL in seconds that a key should be set to after a write. A
+// key that was previously promoted to a longer TTL is never demoted by
+// subsequent ordinary writes, and a key that was pinned so that it never
+// expires (a current TTL of -1) stays that way, which is signaled by
+// returning -1.
+func retentionTTL(conf *IndexConf, interesting bool, currentTTL int) int {
+	if currentTTL == -1 {
+		return -1
+	}
+
+	ttl := int(conf.ttl.Seconds())
+	if interesting && conf.interestingTTL > conf.ttl {
+		ttl = int(conf.interestingTTL.Seconds())
+	}
+
+	if currentTTL > ttl {
+		return currentTTL
+	}
+	return ttl
+}
+
+// Lists the values most recently promoted to a conf's interesting retention,
+// newest first.
+func (r *Retriever) Feed(conf *IndexConf, since time.Duration, offset int,
+	limit int) ([]*RecentKey, error) {
+
+	conn := r.connPool.Get()
+	defer conn.Close()
+
+	if limit <= 0 || limit > RecentMaxLimit {
+		limit = RecentDefaultLimit
+	}
+
+	return listRecent(conn, buildFeedKey(conf.key), since, offset, limit)
+}
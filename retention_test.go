@@ -0,0 +1,138 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestRetentionTTL(t *testing.T) {
+	retentionConf := &IndexConf{
+		interestingTTL: 2 * time.Hour,
+		key:            "request_id",
+		ttl:            1 * time.Hour,
+	}
+
+	cases := []struct {
+		interesting bool
+		currentTTL  int
+		expected    int
+	}{
+		{false, -2, 3600},
+		{true, -2, 7200},
+		{false, 7000, 7000},
+		{false, 100, 3600},
+		{true, -1, -1},
+	}
+	for _, c := range cases {
+		actual := retentionTTL(retentionConf, c.interesting, c.currentTTL)
+		if c.expected != actual {
+			t.Errorf("Expected ttl %v, got %v\n", c.expected, actual)
+		}
+	}
+}
+
+func TestInterestingRetention(t *testing.T) {
+	setup(t)
+
+	retentionConf := &IndexConf{
+		feedMax:        10,
+		interesting:    parsePredicates("at=error"),
+		interestingTTL: 2 * time.Hour,
+		key:            "request_id",
+		maxSize:        2,
+		ttl:            1 * time.Hour,
+	}
+
+	receiver := NewReceiver([]*IndexConf{retentionConf}, connPool)
+	retriever := NewRetriever([]*IndexConf{retentionConf}, connPool)
+
+	conn := connPool.Get()
+	defer conn.Close()
+
+	key := buildKey("request_id", "req1")
+
+	writes := []struct {
+		line     string
+		expected time.Duration
+	}{
+		{"request_id=req1 at=info", 1 * time.Hour},
+		{"request_id=req1 at=error", 2 * time.Hour},
+		{"request_id=req1 at=info", 2 * time.Hour},
+	}
+	for _, write := range writes {
+		_, err := receiver.compress(retentionConf, "req1", [][]byte{[]byte(write.line)})
+		if err != nil {
+			t.Error(err)
+		}
+
+		ttl, err := redis.Int(conn.Do("TTL", key))
+		if err != nil {
+			t.Error(err)
+		}
+
+		expected := int(write.expected.Seconds())
+		if ttl < (expected-10) || ttl > expected {
+			t.Errorf("Expected ttl %v, got %v\n", expected, ttl)
+		}
+	}
+
+	feed, err := retriever.Feed(retentionConf, 0, 0, 0)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(feed) != 1 || feed[0].Value != "req1" {
+		t.Errorf("Expected feed with req1, got %v\n", feed)
+	}
+}
+
+func TestInterestingRetentionWhenFull(t *testing.T) {
+	setup(t)
+
+	retentionConf := &IndexConf{
+		feedMax:        10,
+		interesting:    parsePredicates("at=error"),
+		interestingTTL: 2 * time.Hour,
+		key:            "request_id",
+		maxSize:        2,
+		ttl:            1 * time.Hour,
+	}
+
+	receiver := NewReceiver([]*IndexConf{retentionConf}, connPool)
+	retriever := NewRetriever([]*IndexConf{retentionConf}, connPool)
+
+	// fill the key, then have the trace end in an error that's dropped
+	writes := []string{
+		"request_id=req1 at=info n=1",
+		"request_id=req1 at=info n=2",
+		"request_id=req1 at=error",
+	}
+	for _, line := range writes {
+		_, err := receiver.compress(retentionConf, "req1", [][]byte{[]byte(line)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conn := connPool.Get()
+	defer conn.Close()
+
+	ttl, err := redis.Int(conn.Do("TTL", buildKey("request_id", "req1")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := int(retentionConf.interestingTTL.Seconds())
+	if ttl < (expected-10) || ttl > expected {
+		t.Errorf("Expected ttl %v, got %v\n", expected, ttl)
+	}
+
+	feed, err := retriever.Feed(retentionConf, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(feed) != 1 || feed[0].Value != "req1" {
+		t.Errorf("Expected feed with req1, got %v\n", feed)
+	}
+}
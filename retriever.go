@@ -1,10 +1,21 @@
 package main
 
-import "github.com/garyburd/redigo/redis"
+import (
+	"bytes"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
 
 type Retriever struct {
 	confs    []*IndexConf
 	connPool *redis.Pool
+
+	// Decrypts stored blobs. Optional.
+	encryptor *Encryptor
+
+	// Provides samples of stored keys for stats. Optional.
+	sampler *StatsSampler
 }
 
 func NewRetriever(confs []*IndexConf, connPool *redis.Pool) *Retriever {
@@ -14,25 +25,100 @@ func NewRetriever(confs []*IndexConf, connPool *redis.Pool) *Retriever {
 	}
 }
 
-func (r *Retriever) Lookup(query string) ([]byte, bool, error) {
-	conn := connPool.Get()
+func (r *Retriever) Lookup(query string) (*Blob, bool, error) {
+	conn := r.connPool.Get()
 	defer conn.Close()
 
 	// Move through each type of message stored until there is a match. If
 	// there is never a match, return a 404.
 	for _, conf := range r.confs {
-		key := buildKey(conf.key, query)
-		compressed, err := conn.Do("GET", key)
+		blob, ok, err := r.lookupKey(conn, buildKey(conf.key, query))
 		if err != nil {
 			return nil, false, err
 		}
 
-		if compressed == nil {
+		if !ok {
 			continue
 		}
 
-		return compressed.([]byte), true, nil
+		// the recent keys index knows when the blob was last written to
+		if conf.recentMax > 0 {
+			score, err := redis.Int64(conn.Do("ZSCORE",
+				buildRecentKey(conf.key, "", ""), query))
+			if err == nil {
+				blob.LastModified = time.Unix(score, 0).UTC()
+			} else if err != redis.ErrNil {
+				return nil, false, err
+			}
+		}
+
+		return blob, true, nil
 	}
 
 	return nil, false, nil
 }
+
+func (r *Retriever) lookupKey(conn redis.Conn, key string) (*Blob, bool, error) {
+	compressed, err := conn.Do("GET", key)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if compressed == nil {
+		return nil, false, nil
+	}
+
+	decrypted, err := r.encryptor.Decrypt(key, compressed.([]byte))
+	if err != nil {
+		return nil, false, err
+	}
+
+	blob, err := decodeBlob(decrypted)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return blob, true, nil
+}
+
+// Reduces a blob to only the lines appended after a cursor, which is the
+// number of lines that a client has already seen, and gets the cursor for the
+// blob's end. Traces only ever grow by appending, so lines before the cursor
+// never change. The decompressed content of the returned blob is returned
+// too so that callers serving it uncompressed don't decompress it again.
+func tailBlob(blob *Blob, cursor int) (*Blob, []byte, int, error) {
+	data, err := blob.Decompress()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	end := bytes.Count(data, []byte("\n"))
+	if cursor == 0 {
+		return blob, data, end, nil
+	}
+
+	offset := 0
+	for i := 0; i < cursor && offset < len(data); i++ {
+		offset += bytes.IndexByte(data[offset:], '\n') + 1
+	}
+
+	return &Blob{
+		Codec:        codecs["none"],
+		Data:         data[offset:],
+		LastModified: blob.LastModified,
+	}, data[offset:], end, nil
+}
+
+// Decompresses a stored blob and splits it into its individual lines.
+func readLines(blob *Blob) ([][]byte, error) {
+	b, err := blob.Decompress()
+	if err != nil {
+		return nil, err
+	}
+
+	lines := bytes.Split(bytes.TrimRight(b, "\n"), []byte("\n"))
+	if len(lines) == 1 && len(lines[0]) == 0 {
+		return [][]byte{}, nil
+	}
+	return lines, nil
+}
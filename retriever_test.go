@@ -5,6 +5,8 @@ import (
 	"compress/gzip"
 	"io/ioutil"
 	"testing"
+
+	"github.com/garyburd/redigo/redis"
 )
 
 func TestLookup(t *testing.T) {
@@ -22,20 +24,23 @@ func TestLookup(t *testing.T) {
 	}
 
 	line := "request_id=req1"
-	err = receiver.compress(conf, "req1", [][]byte{[]byte(line)})
+	_, err = receiver.compress(conf, "req1", [][]byte{[]byte(line)})
 	if err != nil {
 		t.Error(err)
 	}
 
-	content, ok, err := retriever.Lookup("req1")
+	blob, ok, err := retriever.Lookup("req1")
 	if err != nil {
 		t.Error(err)
 	}
 	if !ok {
-		t.Errorf("Expected found true, got false\n")
+		t.Fatalf("Expected found true, got false\n")
+	}
+	if blob.Codec.Tag() != "gzip" {
+		t.Errorf("Expected codec %v, got %v\n", "gzip", blob.Codec.Tag())
 	}
 
-	reader, err := gzip.NewReader(bytes.NewBuffer(content))
+	reader, err := gzip.NewReader(bytes.NewBuffer(blob.Data))
 	if err != nil {
 		t.Error(err)
 	}
@@ -52,3 +57,98 @@ func TestLookup(t *testing.T) {
 		t.Errorf("Expected buffer '%v', got '%v'\n", expected, actual)
 	}
 }
+
+func TestLookupEncrypted(t *testing.T) {
+	setup(t)
+
+	encryptor, err := NewEncryptor(
+		map[string][]byte{"k1": bytes.Repeat([]byte("1"), 32)}, "k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver := NewReceiver([]*IndexConf{conf}, connPool)
+	receiver.encryptor = encryptor
+	retriever := NewRetriever([]*IndexConf{conf}, connPool)
+	retriever.encryptor = encryptor
+
+	line := "request_id=req1"
+	for i := 0; i < 2; i++ {
+		_, err = receiver.compress(conf, "req1", [][]byte{[]byte(line)})
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	conn := connPool.Get()
+	defer conn.Close()
+
+	stored, err := redis.Bytes(conn.Do("GET", buildKey("request_id", "req1")))
+	if err != nil {
+		t.Error(err)
+	}
+	if !bytes.HasPrefix(stored, encryptedMagic) {
+		t.Errorf("Expected stored blob to be encrypted\n")
+	}
+
+	blob, ok, err := retriever.Lookup("req1")
+	if err != nil {
+		t.Error(err)
+	}
+	if !ok {
+		t.Fatalf("Expected found true, got false\n")
+	}
+
+	lines, err := readLines(blob)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(lines) != 2 || string(lines[1]) != line {
+		t.Errorf("Expected two lines of '%v', got %v\n", line, lines)
+	}
+}
+
+func TestTailBlob(t *testing.T) {
+	data := []byte("line1\nline2\nline3\n")
+	compressed, err := codecs["gzip"].Compress(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := &Blob{Codec: codecs["gzip"], Data: compressed}
+
+	tail, decompressed, end, err := tailBlob(blob, 0)
+	if err != nil {
+		t.Error(err)
+	}
+	if end != 3 {
+		t.Errorf("Expected cursor %v, got %v\n", 3, end)
+	}
+	if tail != blob {
+		t.Errorf("Expected the whole blob for cursor 0\n")
+	}
+	if string(decompressed) != string(data) {
+		t.Errorf("Expected decompressed %q, got %q\n", string(data), string(decompressed))
+	}
+
+	cases := []struct {
+		cursor   int
+		expected string
+	}{
+		{1, "line2\nline3\n"},
+		{3, ""},
+		{10, ""},
+	}
+	for _, c := range cases {
+		tail, decompressed, end, err := tailBlob(blob, c.cursor)
+		if err != nil {
+			t.Error(err)
+		}
+		if end != 3 {
+			t.Errorf("Expected cursor %v, got %v\n", 3, end)
+		}
+		if string(tail.Data) != c.expected || string(decompressed) != c.expected {
+			t.Errorf("Expected tail %q after %v, got %q\n",
+				c.expected, c.cursor, string(tail.Data))
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// How long the decision to keep or drop a value that falls outside of
+	// its conf's sample is remembered. Should outlast any one request.
+	SampleDecisionTTL = 1 * time.Hour
+
+	// Maximum number of decisions to keep values remembered in memory.
+	SampleDecisionCacheSize = 10000
+)
+
+// RateLimiter counts the lines written to each key within a fixed window of
+// time and rejects writes once a key has gone over its limit. Counts for all
+// keys are reset together at the start of each window so that the limiter's
+// memory is bounded by the number of keys written to in one window.
+type RateLimiter struct {
+	counts      map[string]int
+	mutex       sync.Mutex
+	window      time.Duration
+	windowStart time.Time
+}
+
+func NewRateLimiter(window time.Duration) *RateLimiter {
+	return &RateLimiter{
+		counts:      make(map[string]int),
+		window:      window,
+		windowStart: time.Now(),
+	}
+}
+
+// Records n lines against a key and returns whether they should be allowed
+// given a limit per window.
+func (l *RateLimiter) Allow(key string, n int, limit int) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if time.Since(l.windowStart) >= l.window {
+		l.counts = make(map[string]int)
+		l.windowStart = time.Now()
+	}
+
+	if l.counts[key]+n > limit {
+		return false
+	}
+
+	l.counts[key] += n
+	return true
+}
+
+// Gives back n lines recorded against a key that ended up not being written.
+func (l *RateLimiter) Refund(key string, n int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.counts[key] -= n
+	if l.counts[key] <= 0 {
+		delete(l.counts, key)
+	}
+}
+
+// Decides deterministically whether a value falls within a conf's sample by
+// hashing it. Because the decision depends only on the value, all of its
+// lines are either kept or dropped across batches, processes, and dynos.
+func sampleValue(conf *IndexConf, value string) bool {
+	if conf.sampleRate <= 0 || conf.sampleRate >= 1 {
+		return true
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(value))
+	return float64(hash.Sum32()%10000)/10000 < conf.sampleRate
+}
+
+// Checks whether any of a group's lines match one of its conf's always keep
+// predicates. Lines are parsed again because only their data makes it into
+// a group, but this only happens for values that were sampled out.
+func alwaysKept(conf *IndexConf, lines [][]byte) bool {
+	for _, line := range lines {
+		message := &LogMessage{data: line, pairs: make(map[string]string)}
+		parsers["auto"].Parse(message)
+
+		if matchesAny(conf.alwaysKeep, message) {
+			return true
+		}
+	}
+	return false
+}
+
+// Decides whether a value that falls outside of its conf's sample is kept
+// anyway because of its conf's always keep predicates. A value is dropped
+// until one of its lines matches, and from then on everything after it is
+// kept, including on other dynos, which learn about it through Redis.
+// Values known to be kept are remembered locally so that their later groups
+// don't need a round trip.
+func (r *Receiver) keepUnsampled(conf *IndexConf, value string, keep bool) bool {
+	key := buildSampleKey(conf.key, value)
+	if r.sampleDecisions.Kept(key) {
+		return true
+	}
+
+	if keep {
+		r.sampleDecisions.Keep(key)
+	}
+
+	// nothing to share decisions through, like during a dry run import
+	if r.connPool == nil {
+		return keep
+	}
+
+	conn := r.connPool.Get()
+	defer conn.Close()
+
+	if keep {
+		_, err := conn.Do("SET", key, "1", "EX", int(SampleDecisionTTL.Seconds()))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't record sample decision: %s\n", err.Error())
+		}
+		return true
+	}
+
+	stored, err := redis.String(conn.Do("GET", key))
+	if err != nil {
+		if err != redis.ErrNil {
+			fmt.Fprintf(os.Stderr, "Couldn't read sample decision: %s\n", err.Error())
+		}
+		return false
+	}
+
+	if stored == "1" {
+		r.sampleDecisions.Keep(key)
+		return true
+	}
+	return false
+}
+
+// SampleDecisions remembers the unsampled values that a process has decided
+// to keep for SampleDecisionTTL. It's bounded by forgetting everything once
+// it's full, after which decisions are read back from Redis.
+type SampleDecisions struct {
+	kept  map[string]time.Time
+	mutex sync.Mutex
+}
+
+func NewSampleDecisions() *SampleDecisions {
+	return &SampleDecisions{kept: make(map[string]time.Time)}
+}
+
+func (d *SampleDecisions) Keep(key string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if len(d.kept) >= SampleDecisionCacheSize {
+		d.kept = make(map[string]time.Time)
+	}
+	d.kept[key] = time.Now().Add(SampleDecisionTTL)
+}
+
+func (d *SampleDecisions) Kept(key string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	expires, ok := d.kept[key]
+	if ok && time.Now().After(expires) {
+		delete(d.kept, key)
+		return false
+	}
+	return ok
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(1 * time.Hour)
+
+	if !limiter.Allow("key1", 2, 3) {
+		t.Errorf("Expected allow true, got false\n")
+	}
+	if limiter.Allow("key1", 2, 3) {
+		t.Errorf("Expected allow false, got true\n")
+	}
+	if !limiter.Allow("key1", 1, 3) {
+		t.Errorf("Expected allow true, got false\n")
+	}
+	if !limiter.Allow("key2", 3, 3) {
+		t.Errorf("Expected allow true, got false\n")
+	}
+
+	limiter.Refund("key2", 2)
+	if !limiter.Allow("key2", 2, 3) {
+		t.Errorf("Expected allow true after refund, got false\n")
+	}
+
+	limiter.windowStart = time.Now().Add(-2 * time.Hour)
+	if !limiter.Allow("key1", 3, 3) {
+		t.Errorf("Expected allow true after window reset, got false\n")
+	}
+}
+
+func TestSampleValue(t *testing.T) {
+	sampleConf := &IndexConf{key: "request_id", sampleRate: 0.1}
+
+	kept := 0
+	for i := 0; i < 10000; i++ {
+		value := fmt.Sprintf("req%v", i)
+		if sampleValue(sampleConf, value) {
+			kept++
+		}
+
+		if sampleValue(sampleConf, value) != sampleValue(sampleConf, value) {
+			t.Errorf("Expected sampling of %v to be deterministic\n", value)
+		}
+	}
+
+	if kept < 800 || kept > 1200 {
+		t.Errorf("Expected roughly %v kept, got %v\n", 1000, kept)
+	}
+
+	if !sampleValue(&IndexConf{key: "request_id"}, "req1") {
+		t.Errorf("Expected all values kept with sampling disabled\n")
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	SearchDefaultLimit  = 20
+	SearchMaxCandidates = 1000
+	SearchMaxLimit      = 100
+	SearchMaxTokenSize  = 64
+	SearchMinTokenSize  = 3
+
+	// Maximum number of tokens indexed for each line, and for each group
+	// of lines written at once. Values with lines that went over either
+	// are considered by every search instead.
+	SearchMaxLineTokens = 100
+	SearchMaxTokens     = 1000
+)
+
+type SearchResult struct {
+	Lines []string `json:"lines"`
+	Value string   `json:"value"`
+}
+
+// Records the tokens found in a group of lines in an inverted index of token
+// to the values that they were written under. Every pair produces a
+// `key=value` token in addition to the words in the line so that logfmt
+// predicates can be looked up directly.
+func (r *Receiver) recordSearch(conf *IndexConf, value string, lines [][]byte) error {
+	if conf.searchMax <= 0 {
+		return nil
+	}
+
+	tokens, truncated := searchTokens(conf, lines)
+	if len(tokens) == 0 && !truncated {
+		return nil
+	}
+
+	conn := r.connPool.Get()
+	defer conn.Close()
+
+	now := time.Now().Unix()
+	conn.Send("MULTI")
+	if truncated {
+		key := buildSearchTruncatedKey(conf.key)
+		conn.Send("ZADD", key, now, value)
+		conn.Send("ZREMRANGEBYRANK", key, 0, -(conf.searchMax + 1))
+		conn.Send("EXPIRE", key, int(conf.ttl.Seconds()))
+	}
+	for token := range tokens {
+		key := buildSearchKey(conf.key, r.encryptor.IndexToken(token))
+		conn.Send("ZADD", key, now, value)
+		conn.Send("ZREMRANGEBYRANK", key, 0, -(conf.searchMax + 1))
+		conn.Send("EXPIRE", key, int(conf.ttl.Seconds()))
+	}
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// Searches the values written to within `since` for lines matching all
+// terms in a query. Terms are either words that must appear in a line or
+// logfmt predicates like `at=error` or `status>=500`.
+func (r *Retriever) Search(conf *IndexConf, query string, since time.Duration,
+	limit int) ([]*SearchResult, error) {
+
+	conn := r.connPool.Get()
+	defer conn.Close()
+
+	if limit <= 0 || limit > SearchMaxLimit {
+		limit = SearchDefaultLimit
+	}
+
+	predicates := parsePredicates(query)
+
+	min := "-inf"
+	if since > 0 {
+		min = strconv.FormatInt(time.Now().Add(-since).Unix(), 10)
+	}
+
+	// narrow down candidates using any terms that were indexed, falling back
+	// to the recent keys index if there aren't any
+	var candidates []string
+	for _, p := range predicates {
+		token := p.token()
+		if token == "" {
+			continue
+		}
+
+		values, err := redis.Strings(conn.Do("ZREVRANGEBYSCORE",
+			buildSearchKey(conf.key, r.encryptor.IndexToken(token)), "+inf", min,
+			"LIMIT", 0, SearchMaxCandidates))
+		if err != nil {
+			return nil, err
+		}
+
+		if candidates == nil {
+			candidates = values
+		} else {
+			candidates = intersectStrings(candidates, values)
+		}
+	}
+
+	// values whose tokens weren't all indexed could match any term
+	if candidates != nil {
+		values, err := redis.Strings(conn.Do("ZREVRANGEBYSCORE",
+			buildSearchTruncatedKey(conf.key), "+inf", min,
+			"LIMIT", 0, SearchMaxCandidates))
+		if err != nil {
+			return nil, err
+		}
+		candidates = unionStrings(candidates, values)
+	}
+
+	if candidates == nil {
+		if conf.recentMax <= 0 {
+			return []*SearchResult{}, nil
+		}
+
+		recent, err := r.Recent(conf, nil, since, 0, SearchMaxCandidates)
+		if err != nil {
+			return nil, err
+		}
+
+		candidates = make([]string, len(recent))
+		for i, key := range recent {
+			candidates[i] = key.Value
+		}
+	}
+
+	results := make([]*SearchResult, 0)
+	for _, candidate := range candidates {
+		if len(results) >= limit {
+			break
+		}
+
+		compressed, ok, err := r.lookupKey(conn, buildKey(conf.key, candidate))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		lines, err := readLines(compressed)
+		if err != nil {
+			return nil, err
+		}
+
+		result := &SearchResult{Lines: make([]string, 0), Value: candidate}
+		for _, line := range lines {
+			message := &LogMessage{data: line, pairs: make(map[string]string)}
+			parsers["auto"].Parse(message)
+
+			if matchesAll(predicates, message) {
+				result.Lines = append(result.Lines, string(line))
+			}
+		}
+
+		if len(result.Lines) > 0 {
+			results = append(results, result)
+		}
+	}
+
+	return results, nil
+}
+
+// Produces the token that a predicate would have been indexed under, or an
+// empty string if it can't be looked up in the inverted index.
+func (p *predicate) token() string {
+	var token string
+	if p.term != "" {
+		tokens := tokenize([]byte(p.term))
+		if len(tokens) == 1 && tokens[0] == p.term {
+			token = p.term
+		}
+	} else if p.op == "=" {
+		token = strings.ToLower(p.key + "=" + p.value)
+	}
+
+	// tokens outside of these bounds are never indexed
+	if len(token) < SearchMinTokenSize || len(token) > SearchMaxTokenSize {
+		return ""
+	}
+	return token
+}
+
+// Finds the tokens that a group of lines is indexed under, up to
+// SearchMaxLineTokens for each line and SearchMaxTokens in all. Also returns
+// whether any were left out because of either limit.
+//
+// The values of the conf's own key and its links are left out, both as pairs
+// and as words, because every line of a value would share them and they can
+// be looked up directly anyway.
+func searchTokens(conf *IndexConf, lines [][]byte) (map[string]bool, bool) {
+	tokens := make(map[string]bool)
+	truncated := false
+	for _, line := range lines {
+		message := &LogMessage{data: line, pairs: make(map[string]string)}
+		parsers["auto"].Parse(message)
+
+		skip := make(map[string]bool)
+		for _, key := range append([]string{conf.key}, conf.links...) {
+			if pairValue, ok := message.pairs[key]; ok {
+				skip[strings.ToLower(key+"="+pairValue)] = true
+				for _, word := range tokenize([]byte(pairValue)) {
+					skip[word] = true
+				}
+			}
+		}
+
+		lineTokens := make(map[string]bool)
+		for key, pairValue := range message.pairs {
+			addSearchToken(lineTokens, skip, strings.ToLower(key+"="+pairValue))
+		}
+		for _, token := range tokenize(line) {
+			addSearchToken(lineTokens, skip, token)
+		}
+
+		// sorted so that the same tokens are kept every time a line is
+		// tokenized, like when its entries are deleted
+		sorted := make([]string, 0, len(lineTokens))
+		for token := range lineTokens {
+			sorted = append(sorted, token)
+		}
+		sort.Strings(sorted)
+
+		if len(sorted) > SearchMaxLineTokens {
+			sorted = sorted[0:SearchMaxLineTokens]
+			truncated = true
+		}
+
+		for _, token := range sorted {
+			if !tokens[token] && len(tokens) >= SearchMaxTokens {
+				truncated = true
+				break
+			}
+			tokens[token] = true
+		}
+	}
+	return tokens, truncated
+}
+
+func addSearchToken(tokens map[string]bool, skip map[string]bool, token string) {
+	if len(token) < SearchMinTokenSize || len(token) > SearchMaxTokenSize {
+		return
+	}
+	if skip[token] {
+		return
+	}
+	tokens[token] = true
+}
+
+// Combines two lists of strings, keeping the order of the first and adding
+// anything only found in the second after it.
+func unionStrings(a []string, b []string) []string {
+	inA := make(map[string]bool, len(a))
+	for _, s := range a {
+		inA[s] = true
+	}
+
+	union := append(make([]string, 0, len(a)+len(b)), a...)
+	for _, s := range b {
+		if !inA[s] {
+			inA[s] = true
+			union = append(union, s)
+		}
+	}
+	return union
+}
+
+func intersectStrings(a []string, b []string) []string {
+	inB := make(map[string]bool, len(b))
+	for _, s := range b {
+		inB[s] = true
+	}
+
+	intersection := make([]string, 0)
+	for _, s := range a {
+		if inB[s] {
+			intersection = append(intersection, s)
+		}
+	}
+	return intersection
+}
+
+// Splits a line into lowercased words made up of letters, digits, and a few
+// characters commonly found in identifiers.
+func tokenize(line []byte) []string {
+	words := bytes.FieldsFunc(bytes.ToLower(line), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) &&
+			r != '_' && r != '-' && r != '.'
+	})
+
+	tokens := make([]string, len(words))
+	for i, word := range words {
+		tokens[i] = string(word)
+	}
+	return tokens
+}
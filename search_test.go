@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestPredicateToken(t *testing.T) {
+	predicates := parsePredicates("Timeout at=error status>=500 a")
+
+	expected := []string{"timeout", "at=error", "", ""}
+	for i, token := range expected {
+		if predicates[i].token() != token {
+			t.Errorf("Expected token '%v', got '%v'\n", token, predicates[i].token())
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	setup(t)
+
+	searchConf := &IndexConf{
+		key:       "request_id",
+		maxSize:   2,
+		recentMax: 10,
+		searchMax: 10,
+		ttl:       1 * time.Hour,
+	}
+
+	receiver := NewReceiver([]*IndexConf{searchConf}, connPool)
+	retriever := NewRetriever([]*IndexConf{searchConf}, connPool)
+
+	writes := map[string]string{
+		"req1": "request_id=req1 at=error status=500 msg=\"Request timeout\"",
+		"req2": "request_id=req2 at=info status=200",
+		"req3": "request_id=req3 at=error status=404",
+	}
+	for value, line := range writes {
+		lines := [][]byte{[]byte(line)}
+
+		_, err := receiver.compress(searchConf, value, lines)
+		if err != nil {
+			t.Error(err)
+		}
+		err = receiver.recordRecent(searchConf, value, lines)
+		if err != nil {
+			t.Error(err)
+		}
+		err = receiver.recordSearch(searchConf, value, lines)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	results, err := retriever.Search(searchConf, "at=error", 10*time.Minute, 0)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(results) != 2 {
+		t.Errorf("Expected results length %v, got %v\n", 2, len(results))
+	}
+
+	results, err = retriever.Search(searchConf, "TIMEOUT", 0, 0)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(results) != 1 || results[0].Value != "req1" {
+		t.Errorf("Expected single result for req1, got %v\n", results)
+	}
+
+	// not indexable, so falls back to the recent keys index
+	results, err = retriever.Search(searchConf, "status>=400", 0, 0)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(results) != 2 {
+		t.Errorf("Expected results length %v, got %v\n", 2, len(results))
+	}
+
+	results, err = retriever.Search(searchConf, "at=error status<500", 0, 0)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(results) != 1 || results[0].Value != "req3" {
+		t.Errorf("Expected single result for req3, got %v\n", results)
+	}
+}
+
+func TestSearchEncrypted(t *testing.T) {
+	setup(t)
+
+	searchConf := &IndexConf{
+		key:        "request_id",
+		maxSize:    2,
+		recentMax:  10,
+		recentTags: []string{"at"},
+		searchMax:  10,
+		ttl:        1 * time.Hour,
+	}
+
+	encryptor, err := NewEncryptor(
+		map[string][]byte{"k1": bytes.Repeat([]byte("1"), 32)}, "k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver := NewReceiver([]*IndexConf{searchConf}, connPool)
+	receiver.encryptor = encryptor
+	retriever := NewRetriever([]*IndexConf{searchConf}, connPool)
+	retriever.encryptor = encryptor
+
+	lines := [][]byte{[]byte("request_id=req1 at=error msg=\"Request timeout\"")}
+	if _, err := receiver.compress(searchConf, "req1", lines); err != nil {
+		t.Error(err)
+	}
+	if err := receiver.recordRecent(searchConf, "req1", lines); err != nil {
+		t.Error(err)
+	}
+	if err := receiver.recordSearch(searchConf, "req1", lines); err != nil {
+		t.Error(err)
+	}
+
+	conn := connPool.Get()
+	defer conn.Close()
+
+	keys, err := redis.Strings(conn.Do("KEYS", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if strings.Contains(key, "error") || strings.Contains(key, "timeout") {
+			t.Errorf("Expected no line content in key names, got %v\n", key)
+		}
+	}
+
+	results, err := retriever.Search(searchConf, "at=error timeout", 0, 0)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(results) != 1 || results[0].Value != "req1" {
+		t.Errorf("Expected single result for req1, got %v\n", results)
+	}
+
+	recent, err := retriever.Recent(searchConf, map[string]string{"at": "error"}, 0, 0, 10)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(recent) != 1 || recent[0].Value != "req1" {
+		t.Errorf("Expected req1 in recent errors, got %v\n", recent)
+	}
+}
+
+func TestSearchTokens(t *testing.T) {
+	tokenConf := &IndexConf{
+		key:   "request_id",
+		links: []string{"parent_request_id"},
+	}
+
+	tokens, truncated := searchTokens(tokenConf, [][]byte{
+		[]byte("request_id=req123 parent_request_id=par456 at=error msg=timeout"),
+	})
+	if truncated {
+		t.Errorf("Expected tokens not to be truncated\n")
+	}
+	for _, token := range []string{"at=error", "error", "msg=timeout", "timeout"} {
+		if !tokens[token] {
+			t.Errorf("Expected token %v\n", token)
+		}
+	}
+	for _, token := range []string{"request_id=req123", "req123", "parent_request_id=par456", "par456"} {
+		if tokens[token] {
+			t.Errorf("Expected no token %v\n", token)
+		}
+	}
+
+	// capped for each line, so that later lines still get indexed
+	words := make([]string, 0, SearchMaxLineTokens+50)
+	for i := 0; i < SearchMaxLineTokens+50; i++ {
+		words = append(words, fmt.Sprintf("word%03d", i))
+	}
+	tokens, truncated = searchTokens(tokenConf, [][]byte{
+		[]byte(strings.Join(words, " ")),
+		[]byte("at=error"),
+	})
+	if !truncated {
+		t.Errorf("Expected tokens to be truncated\n")
+	}
+	if len(tokens) != SearchMaxLineTokens+2 {
+		t.Errorf("Expected %v tokens, got %v\n", SearchMaxLineTokens+2, len(tokens))
+	}
+	if !tokens["at=error"] {
+		t.Errorf("Expected token at=error from the second line\n")
+	}
+
+	// and for each group
+	lines := make([][]byte, 0)
+	for i := 0; i < 2*SearchMaxTokens/SearchMaxLineTokens; i++ {
+		line := make([]string, 0, SearchMaxLineTokens)
+		for j := 0; j < SearchMaxLineTokens; j++ {
+			line = append(line, fmt.Sprintf("word%03d-%03d", i, j))
+		}
+		lines = append(lines, []byte(strings.Join(line, " ")))
+	}
+	tokens, truncated = searchTokens(tokenConf, lines)
+	if !truncated {
+		t.Errorf("Expected tokens to be truncated\n")
+	}
+	if len(tokens) != SearchMaxTokens {
+		t.Errorf("Expected %v tokens, got %v\n", SearchMaxTokens, len(tokens))
+	}
+}
+
+func TestSearchTruncated(t *testing.T) {
+	setup(t)
+
+	searchConf := &IndexConf{
+		key:       "request_id",
+		maxSize:   2,
+		searchMax: 10,
+		ttl:       1 * time.Hour,
+	}
+
+	receiver := NewReceiver([]*IndexConf{searchConf}, connPool)
+	retriever := NewRetriever([]*IndexConf{searchConf}, connPool)
+
+	// the last word sorts after the ones that fit in the line's tokens
+	words := []string{"request_id=req1"}
+	for i := 0; i < SearchMaxLineTokens; i++ {
+		words = append(words, fmt.Sprintf("word%03d", i))
+	}
+	words = append(words, "zzz")
+	lines := [][]byte{[]byte(strings.Join(words, " "))}
+
+	if _, err := receiver.compress(searchConf, "req1", lines); err != nil {
+		t.Error(err)
+	}
+	if err := receiver.recordSearch(searchConf, "req1", lines); err != nil {
+		t.Error(err)
+	}
+
+	results, err := retriever.Search(searchConf, "zzz", 0, 0)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(results) != 1 || results[0].Value != "req1" {
+		t.Errorf("Expected single result for req1, got %v\n", results)
+	}
+}
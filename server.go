@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// How often the TLS certificate and key files are checked for changes.
+	CertReloadInterval = 1 * time.Minute
+)
+
+// ServerOptions configures the HTTP server. Zero timeouts mean no timeout.
+type ServerOptions struct {
+	idleTimeout       time.Duration
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+
+	// Paths to a PEM certificate and key to terminate TLS with. Plain HTTP
+	// is served if they're empty.
+	certFile string
+	keyFile  string
+}
+
+func defaultServerOptions() *ServerOptions {
+	return &ServerOptions{
+		idleTimeout:       2 * time.Minute,
+		readHeaderTimeout: 10 * time.Second,
+		readTimeout:       30 * time.Second,
+		writeTimeout:      60 * time.Second,
+	}
+}
+
+// Reads server options from the environment, using defaults for any that
+// aren't set.
+func parseServerOptions() (*ServerOptions, error) {
+	options := defaultServerOptions()
+
+	durations := map[string]*time.Duration{
+		"SERVER_IDLE_TIMEOUT":        &options.idleTimeout,
+		"SERVER_READ_HEADER_TIMEOUT": &options.readHeaderTimeout,
+		"SERVER_READ_TIMEOUT":        &options.readTimeout,
+		"SERVER_WRITE_TIMEOUT":       &options.writeTimeout,
+	}
+	for name, duration := range durations {
+		if os.Getenv(name) == "" {
+			continue
+		}
+
+		var err error
+		*duration, err = time.ParseDuration(os.Getenv(name))
+		if err != nil || *duration < 0 {
+			return nil, fmt.Errorf("%s must be a duration like `30s`", name)
+		}
+	}
+
+	options.certFile = os.Getenv("TLS_CERT_FILE")
+	options.keyFile = os.Getenv("TLS_KEY_FILE")
+	if (options.certFile == "") != (options.keyFile == "") {
+		return nil, fmt.Errorf("Need both TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+
+	return options, nil
+}
+
+// Builds a server with the configured timeouts. With a certificate, the
+// server terminates TLS and negotiates HTTP/2 with clients that support it.
+func newServer(addr string, handler http.Handler, options *ServerOptions) (*http.Server, *CertReloader, error) {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		IdleTimeout:       options.idleTimeout,
+		ReadHeaderTimeout: options.readHeaderTimeout,
+		ReadTimeout:       options.readTimeout,
+		WriteTimeout:      options.writeTimeout,
+	}
+
+	if options.certFile == "" {
+		return server, nil, nil
+	}
+
+	reloader, err := NewCertReloader(options.certFile, options.keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// HTTP/2 is set up by ServeTLS as long as TLSNextProto is left nil
+	server.TLSConfig = &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	return server, reloader, nil
+}
+
+// Serves plain HTTP, or TLS if the server has a certificate.
+func listenAndServe(server *http.Server) error {
+	if server.TLSConfig == nil {
+		return server.ListenAndServe()
+	}
+
+	// the certificate comes from TLSConfig.GetCertificate
+	return server.ListenAndServeTLS("", "")
+}
+
+// CertReloader holds a TLS certificate loaded from files, and loads it again
+// when the files change so that renewed certificates are picked up without a
+// restart.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mutex   sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	reloader := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := reloader.Reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.cert, nil
+}
+
+// Loads the certificate again if either of its files has changed since it
+// was last loaded. Returns whether it was loaded. The current certificate is
+// kept if the new one can't be loaded, which can happen if the check races
+// with one file being written before the other.
+func (c *CertReloader) Reload() (bool, error) {
+	modTime, err := latestModTime(c.certFile, c.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	c.mutex.Lock()
+	unchanged := c.cert != nil && modTime.Equal(c.modTime)
+	c.mutex.Unlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	c.mutex.Lock()
+	c.cert = &cert
+	c.modTime = modTime
+	c.mutex.Unlock()
+	return true, nil
+}
+
+// Checks for a changed certificate every interval.
+func (c *CertReloader) Watch(interval time.Duration) {
+	go func() {
+		for {
+			time.Sleep(interval)
+
+			reloaded, err := c.Reload()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Couldn't reload certificate: %s\n", err.Error())
+				continue
+			}
+			if reloaded {
+				printVerbose("reload_certificate cert_file=%v\n", c.certFile)
+			}
+		}
+	}()
+}
+
+func latestModTime(paths ...string) (time.Time, error) {
+	var latest time.Time
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseServerOptions(t *testing.T) {
+	os.Setenv("SERVER_READ_TIMEOUT", "5s")
+	defer os.Unsetenv("SERVER_READ_TIMEOUT")
+
+	options, err := parseServerOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.readTimeout != 5*time.Second {
+		t.Errorf("Expected read timeout %v, got %v\n", 5*time.Second, options.readTimeout)
+	}
+	if options.readHeaderTimeout != 10*time.Second {
+		t.Errorf("Expected read header timeout %v, got %v\n",
+			10*time.Second, options.readHeaderTimeout)
+	}
+
+	os.Setenv("TLS_CERT_FILE", "cert.pem")
+	defer os.Unsetenv("TLS_CERT_FILE")
+
+	_, err = parseServerOptions()
+	if err == nil {
+		t.Errorf("Expected an error for a certificate without a key\n")
+	}
+}
+
+func TestServerTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lvat-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	roots := writeTestCertificate(t, certFile, keyFile)
+
+	options := defaultServerOptions()
+	options.certFile = certFile
+	options.keyFile = keyFile
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+	server, reloader, err := newServer("", handler, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeTLS(listener, "", "")
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		ForceAttemptHTTP2: true,
+		TLSClientConfig:   &tls.Config{RootCAs: roots},
+	}}
+	url := "https://" + listener.Addr().String()
+
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != "HTTP/2.0" {
+		t.Errorf("Expected protocol %v, got %v\n", "HTTP/2.0", string(body))
+	}
+
+	// an unchanged certificate isn't loaded again
+	reloaded, err := reloader.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded {
+		t.Errorf("Expected unchanged certificate not to be reloaded\n")
+	}
+
+	// renew the certificate and make sure that new connections get it
+	writeTestCertificate(t, certFile, keyFile)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+
+	reloaded, err = reloader.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reloaded {
+		t.Errorf("Expected changed certificate to be reloaded\n")
+	}
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(),
+		&tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	served := conn.ConnectionState().PeerCertificates[0].Raw
+	renewed, _ := ioutil.ReadFile(certFile)
+	block, _ := pem.Decode(renewed)
+	if !bytes.Equal(served, block.Bytes) {
+		t.Errorf("Expected renewed certificate to be served\n")
+	}
+}
+
+// Writes a new self-signed certificate and its key as PEM files. Returns a
+// pool that trusts the certificate.
+func writeTestCertificate(t *testing.T, certFile, keyFile string) *x509.CertPool {
+	cert, roots := testCertificate(t)
+
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return roots
+}
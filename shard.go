@@ -0,0 +1,80 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+)
+
+const (
+	// Number of groups that can be waiting on each shard.
+	ShardBufferSize = 10
+)
+
+// StoreJob is a group of lines to be written to a single key.
+type StoreJob struct {
+	conf  *IndexConf
+	lines [][]byte
+	value string
+}
+
+// Groups batches of received messages and routes each group to the shard
+// responsible for its key until MessagesChan is closed. Sampling and rate
+// limiting are left to the shards so that the single dispatcher does no more
+// than it has to.
+func (r *Receiver) dispatch() {
+	for messages := range r.MessagesChan {
+		for conf, confGroups := range r.buildGroups(messages) {
+			for value, lines := range confGroups {
+				r.route(&StoreJob{conf: conf, lines: lines, value: value})
+			}
+		}
+	}
+}
+
+// Sends a job to the shard that its key hashes to. The number of shards is
+// fixed, so a key always goes to the same one and its lines are written in
+// order no matter how the number of workers changes. Writes from other
+// processes are still guarded against by optimistic locking.
+func (r *Receiver) route(job *StoreJob) {
+	shard := shardIndex(buildKey(job.conf.key, job.value), len(r.shards))
+	r.shards[shard] <- job
+}
+
+func shardIndex(key string, shards int) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return int(hash.Sum32() % uint32(shards))
+}
+
+// Writes the jobs routed to a shard until it's closed, waiting for one of
+// the target number of workers to be free before each.
+func (r *Receiver) handleShard(i int) {
+	atomic.AddInt32(&r.workers, 1)
+	defer atomic.AddInt32(&r.workers, -1)
+
+	for job := range r.shards[i] {
+		r.acquireWorker()
+		r.handleGroup(job.conf, job.value, job.lines)
+		r.releaseWorker()
+	}
+}
+
+// Waits until fewer than the target number of shards are writing, and
+// counts the caller as one of them.
+func (r *Receiver) acquireWorker() {
+	r.writingMutex.Lock()
+	defer r.writingMutex.Unlock()
+
+	for int(atomic.LoadInt32(&r.writing)) >= r.Target() {
+		r.writingCond.Wait()
+	}
+	atomic.AddInt32(&r.writing, 1)
+}
+
+func (r *Receiver) releaseWorker() {
+	r.writingMutex.Lock()
+	defer r.writingMutex.Unlock()
+
+	atomic.AddInt32(&r.writing, -1)
+	r.writingCond.Signal()
+}
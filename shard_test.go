@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	shardConf = &IndexConf{
+		key:     "request_id",
+		maxSize: 100000,
+		ttl:     1 * time.Hour,
+	}
+)
+
+func TestShardIndex(t *testing.T) {
+	for _, shards := range []int{1, 7, 40} {
+		for i := 0; i < 100; i++ {
+			key := buildKey("request_id", fmt.Sprintf("req%v", i))
+
+			shard := shardIndex(key, shards)
+			if shard < 0 || shard >= shards {
+				t.Errorf("Expected shard in [0, %v), got %v\n", shards, shard)
+			}
+			if shardIndex(key, shards) != shard {
+				t.Errorf("Expected key %v to always route to shard %v\n", key, shard)
+			}
+		}
+	}
+}
+
+func TestReceiverSharding(t *testing.T) {
+	setup(t)
+
+	options := defaultWorkerOptions()
+	options.minWorkers = 8
+	options.maxWorkers = 8
+
+	subject := NewReceiverWithOptions([]*IndexConf{shardConf}, connPool, options)
+	subject.Run()
+
+	batches := contentionBatches(20, 3)
+	for _, batch := range batches {
+		subject.MessagesChan <- batch
+	}
+	close(subject.MessagesChan)
+	<-subject.done
+
+	if subject.Workers() != 0 {
+		t.Errorf("Expected every worker to have stopped, got %v\n", subject.Workers())
+	}
+
+	if subject.Metrics().Conflicts != 0 {
+		t.Errorf("Expected no conflicts, got %v\n", subject.Metrics().Conflicts)
+	}
+
+	retriever := NewRetriever([]*IndexConf{shardConf}, connPool)
+	for i := 0; i < 3; i++ {
+		blob, ok, err := retriever.Lookup(fmt.Sprintf("req%v", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatalf("Expected req%v to be stored\n", i)
+		}
+
+		lines, err := readLines(blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(lines) != len(batches) {
+			t.Errorf("Expected %v lines for req%v, got %v\n", len(batches), i, len(lines))
+		}
+
+		// lines are stored in the order that their batches were received
+		for j, line := range lines {
+			expected := fmt.Sprintf("request_id=req%v line=%v", i, j)
+			if string(line) != expected {
+				t.Errorf("Expected line %v of req%v to be %q, got %q\n", j, i, expected, line)
+				break
+			}
+		}
+	}
+}
+
+// Compares conflicts between workers writing to a few hot keys when batches
+// are handed to any worker, as they were before sharding, and when each key
+// is routed to a single worker.
+func BenchmarkReceiverContention(b *testing.B) {
+	b.Run("unsharded", func(b *testing.B) {
+		flushBenchmark(b)
+
+		subject := NewReceiver([]*IndexConf{shardConf}, connPool)
+		batches := make(chan []*LogMessage, b.N)
+		for _, batch := range contentionBatches(b.N, 4) {
+			batches <- batch
+		}
+		close(batches)
+
+		b.ResetTimer()
+		var wg sync.WaitGroup
+		for i := 0; i < Concurrency; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for batch := range batches {
+					subject.storeGroups(subject.buildGroups(batch))
+				}
+			}()
+		}
+		wg.Wait()
+
+		b.ReportMetric(float64(atomic.LoadInt64(&subject.conflicts))/float64(b.N), "conflicts/op")
+	})
+
+	b.Run("sharded", func(b *testing.B) {
+		flushBenchmark(b)
+
+		subject := NewReceiverWithOptions([]*IndexConf{shardConf}, connPool,
+			defaultWorkerOptions())
+		batches := contentionBatches(b.N, 4)
+
+		b.ResetTimer()
+		subject.Run()
+		for _, batch := range batches {
+			subject.MessagesChan <- batch
+		}
+		close(subject.MessagesChan)
+		<-subject.done
+
+		b.ReportMetric(float64(atomic.LoadInt64(&subject.conflicts))/float64(b.N), "conflicts/op")
+	})
+}
+
+// Builds batches that each have a line for every one of a few request IDs,
+// like the batches of a busy app whose requests log throughout.
+func contentionBatches(n, keys int) [][]*LogMessage {
+	batches := make([][]*LogMessage, n)
+	for i := range batches {
+		batches[i] = make([]*LogMessage, keys)
+		for j := range batches[i] {
+			value := fmt.Sprintf("req%v", j)
+			batches[i][j] = &LogMessage{
+				data:  []byte(fmt.Sprintf("request_id=%v line=%v", value, i)),
+				pairs: map[string]string{"request_id": value, "line": fmt.Sprint(i)},
+			}
+		}
+	}
+	return batches
+}
+
+func flushBenchmark(b *testing.B) {
+	conn := connPool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("FLUSHALL"); err != nil {
+		b.Fatal(err)
+	}
+}
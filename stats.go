@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	StatsSampleInterval = 10 * time.Minute
+	StatsSampleSize     = 200
+
+	// Fields of the hash of counters kept for each conf.
+	StatsKeysCreated   = "keys_created"
+	StatsKeysTruncated = "keys_truncated"
+	StatsLinesDropped  = "lines_dropped"
+	StatsLinesWritten  = "lines_written"
+)
+
+var (
+	// Upper bounds of the buckets of the TTL distribution, along with their
+	// names. Keys that never expire go in a separate `pinned` bucket.
+	statsTTLBuckets = []struct {
+		max  time.Duration
+		name string
+	}{
+		{1 * time.Hour, "1h"},
+		{6 * time.Hour, "6h"},
+		{24 * time.Hour, "24h"},
+		{7 * 24 * time.Hour, "7d"},
+	}
+)
+
+type IndexStats struct {
+	FeedKeys   int    `json:"feed_keys"`
+	Index      string `json:"index"`
+	RecentKeys int    `json:"recent_keys"`
+
+	// Counters maintained by the Receiver as keys are written.
+	KeysCreated   int `json:"keys_created"`
+	KeysTruncated int `json:"keys_truncated"`
+	LinesDropped  int `json:"lines_dropped"`
+	LinesWritten  int `json:"lines_written"`
+
+	// Estimated from the last sample of stored keys, if there's been one.
+	*IndexSample
+}
+
+// IndexSample describes the keys stored for a conf based on a sample of
+// them.
+type IndexSample struct {
+	AverageBytes     int            `json:"average_bytes"`
+	CompressionRatio float64        `json:"compression_ratio"`
+	Keys             int            `json:"keys"`
+	MemoryBytes      int64          `json:"memory_bytes"`
+	SampledAt        time.Time      `json:"sampled_at"`
+	SampledKeys      int            `json:"sampled_keys"`
+	TotalBytes       int64          `json:"total_bytes"`
+	TTLs             map[string]int `json:"ttls"`
+}
+
+// StatsSampler periodically samples the keys stored for each conf to
+// estimate how much space they take.
+type StatsSampler struct {
+	retriever *Retriever
+
+	mutex   sync.Mutex
+	samples map[string]*IndexSample
+}
+
+func NewStatsSampler(retriever *Retriever) *StatsSampler {
+	return &StatsSampler{
+		retriever: retriever,
+		samples:   make(map[string]*IndexSample),
+	}
+}
+
+// Samples right away, then every interval.
+func (s *StatsSampler) Run(interval time.Duration) {
+	go func() {
+		for {
+			if err := s.Sample(); err != nil {
+				fmt.Fprintf(os.Stderr, "Couldn't sample stats: %s\n", err.Error())
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// Counts every key of each conf, and measures the size, compression, and TTL
+// of up to StatsSampleSize of them.
+func (s *StatsSampler) Sample() error {
+	conn := s.retriever.connPool.Get()
+	defer conn.Close()
+
+	for _, conf := range s.retriever.confs {
+		sample, err := s.sampleConf(conn, conf)
+		if err != nil {
+			return err
+		}
+
+		printVerbose("sample_stats key=%v keys=%v sampled=%v\n",
+			conf.key, sample.Keys, sample.SampledKeys)
+
+		s.mutex.Lock()
+		s.samples[conf.key] = sample
+		s.mutex.Unlock()
+	}
+	return nil
+}
+
+func (s *StatsSampler) sampleConf(conn redis.Conn, conf *IndexConf) (*IndexSample, error) {
+	sample := &IndexSample{
+		SampledAt: time.Now().UTC(),
+		TTLs:      make(map[string]int),
+	}
+
+	var compressedBytes, decompressedBytes, memoryBytes int64
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor,
+			"MATCH", buildKey(conf.key, "*"), "COUNT", 1000))
+		if err != nil {
+			return nil, err
+		}
+
+		cursor, _ = redis.Int(values[0], nil)
+		keys, _ := redis.Strings(values[1], nil)
+		sample.Keys += len(keys)
+
+		for _, key := range keys {
+			if sample.SampledKeys >= StatsSampleSize {
+				break
+			}
+
+			size, err := redis.Int64(conn.Do("STRLEN", key))
+			if err != nil {
+				return nil, err
+			}
+
+			// expired since the scan
+			if size == 0 {
+				continue
+			}
+
+			ttl, err := redis.Int(conn.Do("TTL", key))
+			if err != nil {
+				return nil, err
+			}
+
+			// not available on older versions of Redis, in which case the
+			// size of the value itself will have to do
+			memory, err := redis.Int64(conn.Do("MEMORY", "USAGE", key))
+			if err != nil {
+				memory = size
+			}
+
+			blob, ok, err := s.retriever.lookupKey(conn, key)
+			if err != nil || !ok {
+				continue
+			}
+
+			data, err := blob.Decompress()
+			if err != nil {
+				continue
+			}
+
+			sample.SampledKeys++
+			sample.TTLs[ttlBucket(ttl)]++
+			compressedBytes += size
+			decompressedBytes += int64(len(data))
+			memoryBytes += memory
+		}
+
+		if cursor == 0 {
+			break
+		}
+	}
+
+	if sample.SampledKeys > 0 {
+		sample.AverageBytes = int(compressedBytes / int64(sample.SampledKeys))
+		sample.CompressionRatio = float64(decompressedBytes) / float64(compressedBytes)
+		sample.TotalBytes = int64(sample.AverageBytes) * int64(sample.Keys)
+		sample.MemoryBytes = memoryBytes / int64(sample.SampledKeys) * int64(sample.Keys)
+	}
+	return sample, nil
+}
+
+// Gets the latest sample for a conf.
+func (s *StatsSampler) latest(key string) *IndexSample {
+	if s == nil {
+		return nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.samples[key]
+}
+
+// Names the bucket of the TTL distribution that a TTL in seconds falls in.
+func ttlBucket(ttl int) string {
+	if ttl < 0 {
+		return "pinned"
+	}
+
+	for _, bucket := range statsTTLBuckets {
+		if time.Duration(ttl)*time.Second <= bucket.max {
+			return bucket.name
+		}
+	}
+	return "longer"
+}
+
+// Reports the size of each conf's indexes of recent and interesting keys,
+// its write counters, and the latest sample of its stored keys.
+func (r *Retriever) Stats() ([]*IndexStats, error) {
+	conn := r.connPool.Get()
+	defer conn.Close()
+
+	stats := make([]*IndexStats, len(r.confs))
+	for i, conf := range r.confs {
+		conn.Send("ZCARD", buildRecentKey(conf.key, "", ""))
+		conn.Send("ZCARD", buildFeedKey(conf.key))
+		conn.Send("HGETALL", buildStatsKey(conf.key))
+		conn.Flush()
+
+		recentKeys, err := redis.Int(conn.Receive())
+		if err != nil {
+			return nil, err
+		}
+
+		feedKeys, err := redis.Int(conn.Receive())
+		if err != nil {
+			return nil, err
+		}
+
+		pairs, err := redis.Strings(conn.Receive())
+		if err != nil {
+			return nil, err
+		}
+
+		counters := make(map[string]int)
+		for j := 0; j+1 < len(pairs); j += 2 {
+			counters[pairs[j]], _ = strconv.Atoi(pairs[j+1])
+		}
+
+		stats[i] = &IndexStats{
+			FeedKeys:      feedKeys,
+			Index:         conf.key,
+			IndexSample:   r.sampler.latest(conf.key),
+			KeysCreated:   counters[StatsKeysCreated],
+			KeysTruncated: counters[StatsKeysTruncated],
+			LinesDropped:  counters[StatsLinesDropped],
+			LinesWritten:  counters[StatsLinesWritten],
+			RecentKeys:    recentKeys,
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTTLBucket(t *testing.T) {
+	cases := []struct {
+		ttl      int
+		expected string
+	}{
+		{-1, "pinned"},
+		{60, "1h"},
+		{3600, "1h"},
+		{3601, "6h"},
+		{48 * 3600, "7d"},
+		{30 * 24 * 3600, "longer"},
+	}
+	for _, c := range cases {
+		actual := ttlBucket(c.ttl)
+		if actual != c.expected {
+			t.Errorf("Expected bucket %v for %v, got %v\n", c.expected, c.ttl, actual)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	setup(t)
+
+	receiver := NewReceiver([]*IndexConf{conf}, connPool)
+	retriever := NewRetriever([]*IndexConf{conf}, connPool)
+
+	for _, value := range []string{"req1", "req2", "req3"} {
+		line := []byte("request_id=" + value + " message=\"" + strings.Repeat("repeated ", 50) + "\"")
+		if _, err := receiver.compress(conf, value, [][]byte{line, line}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := retriever.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats[0].LinesWritten != 6 {
+		t.Errorf("Expected %v lines written, got %v\n", 6, stats[0].LinesWritten)
+	}
+	if stats[0].KeysCreated != 3 {
+		t.Errorf("Expected %v keys created, got %v\n", 3, stats[0].KeysCreated)
+	}
+	if stats[0].IndexSample != nil {
+		t.Errorf("Expected no sample before sampling\n")
+	}
+
+	retriever.sampler = NewStatsSampler(retriever)
+	if err := retriever.sampler.Sample(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err = retriever.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sample := stats[0].IndexSample
+	if sample == nil {
+		t.Fatalf("Expected a sample\n")
+	}
+	if sample.Keys != 3 {
+		t.Errorf("Expected %v keys, got %v\n", 3, sample.Keys)
+	}
+	if sample.CompressionRatio <= 1 {
+		t.Errorf("Expected some compression, got ratio %v\n", sample.CompressionRatio)
+	}
+	if sample.TotalBytes != int64(sample.AverageBytes*3) {
+		t.Errorf("Expected total bytes %v, got %v\n", sample.AverageBytes*3, sample.TotalBytes)
+	}
+	if sample.TTLs["1h"] != 3 {
+		t.Errorf("Expected %v keys in the 1h bucket, got %v\n", 3, sample.TTLs["1h"])
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	TraceMaxDepth = 3
+	TraceMaxKeys  = 50
+	TraceMaxLines = 5000
+)
+
+// Pair keys checked for a timestamp when ordering the lines of a trace.
+var traceTimeKeys = []string{"time", "timestamp", "ts"}
+
+type traceKey struct {
+	conf  *IndexConf
+	depth int
+	value string
+}
+
+type traceLine struct {
+	data []byte
+	time time.Time
+}
+
+// Assembles a trace starting from a single identifier by reading its stored
+// lines, discovering other identifiers for any configured index within them
+// (either under the index's own key or one of its link keys), and following
+// those recursively up to maxDepth.
+//
+// Lines stored under more than one key are only included as many times as
+// the key that has the most of them, so that a line repeated on purpose
+// isn't collapsed. Lines are ordered by any timestamp they contain. Lines
+// without a timestamp are ordered alongside the line that preceded them
+// under the same key. The time of the Logplex frame that carried a line
+// isn't stored, so it can't be used.
+func (r *Retriever) Trace(query string, maxDepth int) ([][]byte, bool, error) {
+	conn := r.connPool.Get()
+	defer conn.Close()
+
+	if maxDepth > TraceMaxDepth {
+		maxDepth = TraceMaxDepth
+	}
+
+	queue := make([]*traceKey, 0, len(r.confs))
+	seenKeys := make(map[string]bool)
+	for _, conf := range r.confs {
+		queue = append(queue, &traceKey{conf: conf, value: query})
+		seenKeys[buildKey(conf.key, query)] = true
+	}
+
+	found := false
+	lines := make([]*traceLine, 0)
+
+	// times each line has been included so far
+	seenLines := make(map[string]int)
+
+	for len(queue) > 0 && len(lines) < TraceMaxLines {
+		next := queue[0]
+		queue = queue[1:]
+
+		compressed, ok, err := r.lookupKey(conn, buildKey(next.conf.key, next.value))
+		if err != nil {
+			return nil, false, err
+		}
+		if !ok {
+			continue
+		}
+		found = true
+
+		keyLines, err := readLines(compressed)
+		if err != nil {
+			return nil, false, err
+		}
+
+		keyCounts := make(map[string]int)
+		var lastTime time.Time
+		for _, data := range keyLines {
+			message := &LogMessage{data: data, pairs: make(map[string]string)}
+			parsers["auto"].Parse(message)
+
+			if t, ok := traceTime(message); ok {
+				lastTime = t
+			}
+
+			keyCounts[string(data)]++
+			if keyCounts[string(data)] > seenLines[string(data)] && len(lines) < TraceMaxLines {
+				seenLines[string(data)] = keyCounts[string(data)]
+				lines = append(lines, &traceLine{data: data, time: lastTime})
+			}
+
+			if next.depth >= maxDepth {
+				continue
+			}
+
+			for _, linked := range r.traceLinks(message) {
+				key := buildKey(linked.conf.key, linked.value)
+				if seenKeys[key] || len(seenKeys) >= TraceMaxKeys {
+					continue
+				}
+				seenKeys[key] = true
+
+				linked.depth = next.depth + 1
+				queue = append(queue, linked)
+			}
+		}
+	}
+
+	sort.Stable(traceLinesByTime(lines))
+
+	data := make([][]byte, len(lines))
+	for i, line := range lines {
+		data[i] = line.data
+	}
+
+	return data, found, nil
+}
+
+// Finds all the identifiers for configured indexes within a message.
+func (r *Retriever) traceLinks(message *LogMessage) []*traceKey {
+	links := make([]*traceKey, 0)
+	for _, conf := range r.confs {
+		rawValues := make([]string, 0, 1+len(conf.links))
+		if value, ok := indexValue(conf, message); ok {
+			rawValues = append(rawValues, value)
+		}
+		for _, link := range conf.links {
+			if value, ok := message.pairs[link]; ok {
+				rawValues = append(rawValues, value)
+			}
+		}
+
+		for _, rawValue := range rawValues {
+			for _, value := range normalizeValues(conf, rawValue) {
+				links = append(links, &traceKey{conf: conf, value: value})
+			}
+		}
+	}
+	return links
+}
+
+func traceTime(message *LogMessage) (time.Time, bool) {
+	for _, key := range traceTimeKeys {
+		value, ok := message.pairs[key]
+		if !ok {
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+type traceLinesByTime []*traceLine
+
+func (l traceLinesByTime) Len() int           { return len(l) }
+func (l traceLinesByTime) Less(i, j int) bool { return l[i].time.Before(l[j].time) }
+func (l traceLinesByTime) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
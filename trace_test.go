@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrace(t *testing.T) {
+	setup(t)
+
+	traceConf := &IndexConf{
+		key:       "request_id",
+		links:     []string{"parent_request_id"},
+		maxSize:   2,
+		separator: ",",
+		ttl:       1 * time.Hour,
+	}
+
+	receiver := NewReceiver([]*IndexConf{traceConf}, connPool)
+	retriever := NewRetriever([]*IndexConf{traceConf}, connPool)
+
+	lines := map[string][]string{
+		"req1": []string{
+			"time=2015-01-01T00:00:02Z request_id=req1 parent_request_id=req2",
+			"time=2015-01-01T00:00:04Z request_id=req1,req3",
+		},
+		"req2": []string{
+			"time=2015-01-01T00:00:01Z request_id=req2",
+		},
+		"req3": []string{
+			"time=2015-01-01T00:00:04Z request_id=req1,req3",
+			"time=2015-01-01T00:00:03Z request_id=req3 parent_request_id=req4",
+		},
+		"req4": []string{
+			"time=2015-01-01T00:00:00Z request_id=req4",
+		},
+	}
+	for value, valueLines := range lines {
+		data := make([][]byte, len(valueLines))
+		for i, line := range valueLines {
+			data[i] = []byte(line)
+		}
+
+		_, err := receiver.compress(traceConf, value, data)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	trace, ok, err := retriever.Trace("req1", 1)
+	if err != nil {
+		t.Error(err)
+	}
+	if !ok {
+		t.Errorf("Expected found true, got false\n")
+	}
+
+	expected := []string{
+		"time=2015-01-01T00:00:01Z request_id=req2",
+		"time=2015-01-01T00:00:02Z request_id=req1 parent_request_id=req2",
+		"time=2015-01-01T00:00:03Z request_id=req3 parent_request_id=req4",
+		"time=2015-01-01T00:00:04Z request_id=req1,req3",
+	}
+	if len(expected) != len(trace) {
+		t.Fatalf("Expected trace length %v, got %v\n", len(expected), len(trace))
+	}
+	for i, line := range expected {
+		if line != string(trace[i]) {
+			t.Errorf("Expected line %v '%v', got '%v'\n", i, line, string(trace[i]))
+		}
+	}
+
+	_, ok, err = retriever.Trace("req5", 1)
+	if err != nil {
+		t.Error(err)
+	}
+	if ok {
+		t.Errorf("Expected found false, got true\n")
+	}
+}
+
+func TestTraceRepeatedLines(t *testing.T) {
+	setup(t)
+
+	traceConf := &IndexConf{
+		key:       "request_id",
+		maxSize:   2,
+		separator: ",",
+		ttl:       1 * time.Hour,
+	}
+
+	receiver := NewReceiver([]*IndexConf{traceConf}, connPool)
+	retriever := NewRetriever([]*IndexConf{traceConf}, connPool)
+
+	// logged twice for both keys, but req2 only kept one of them, so the
+	// trace has it as many times as req1 does
+	line := []byte("request_id=req1,req2 at=retry")
+	if _, err := receiver.compress(traceConf, "req1", [][]byte{line, line}); err != nil {
+		t.Error(err)
+	}
+	if _, err := receiver.compress(traceConf, "req2", [][]byte{line}); err != nil {
+		t.Error(err)
+	}
+
+	trace, _, err := retriever.Trace("req1", 1)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(trace) != 2 {
+		t.Errorf("Expected trace length %v, got %v\n", 2, len(trace))
+	}
+}
@@ -1,6 +1,25 @@
 package main
 
-import "testing"
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
 
 func TestBuildKey(t *testing.T) {
 	actual := buildKey("request_id", "req1")
@@ -9,3 +28,247 @@ func TestBuildKey(t *testing.T) {
 		t.Errorf("Expected key %v, got %v\n", expected, actual)
 	}
 }
+
+func TestRedisConnectTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "redis.crt")
+	keyFile := filepath.Join(dir, "redis.key")
+	roots := writeTestCertificate(t, certFile, keyFile)
+	addr := testRedisServer(t,
+		"--port", "0",
+		"--tls-port", "{port}",
+		"--tls-cert-file", certFile,
+		"--tls-key-file", keyFile,
+		"--tls-ca-cert-file", certFile,
+		"--tls-auth-clients", "no")
+
+	conn, err := redisConnect("rediss://"+addr, &RedisOptions{
+		tlsConfig: &tls.Config{RootCAs: roots},
+	})()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	reply, err := redis.String(conn.Do("PING"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != "PONG" {
+		t.Errorf("Expected reply %v, got %v\n", "PONG", reply)
+	}
+
+	// without the CA, the server's certificate can't be verified
+	_, err = redisConnect("rediss://"+addr, &RedisOptions{})()
+	if err == nil {
+		t.Errorf("Expected an error for an untrusted certificate\n")
+	}
+}
+
+func TestRedisConnectAuth(t *testing.T) {
+	addr := testRedisServer(t,
+		"--port", "{port}",
+		"--requirepass", "default-secret",
+		"--user", "alice on >alice-secret ~* &* +@all")
+
+	cases := []struct {
+		userinfo string
+		ok       bool
+	}{
+		{"alice:alice-secret", true},
+		{":default-secret", true},
+
+		// the placeholder user falls back to the password alone
+		{RedisPlaceholderUser + ":default-secret", true},
+
+		// other users never fall back to the default user
+		{"bob:default-secret", false},
+		{"alice:default-secret", false},
+		{"alice:wrong", false},
+	}
+
+	for _, c := range cases {
+		conn, err := redisConnect("redis://"+c.userinfo+"@"+addr, nil)()
+		if err == nil {
+			_, err = conn.Do("PING")
+			conn.Close()
+		}
+		if (err == nil) != c.ok {
+			t.Errorf("Expected %v to authenticate %v, got error %v\n",
+				c.userinfo, c.ok, err)
+		}
+	}
+}
+
+func TestRedisAuthFallback(t *testing.T) {
+	cases := []struct {
+		user     *url.Userinfo
+		aclErr   error
+		expected []string
+		ok       bool
+	}{
+		{url.UserPassword("alice", "secret"), nil, []string{"alice secret"}, true},
+		{url.UserPassword("", "secret"), nil, []string{"secret"}, true},
+		{url.User("alice"), nil, nil, true},
+
+		// servers before Redis 6 don't take a user
+		{url.UserPassword("alice", "secret"),
+			redis.Error("ERR wrong number of arguments for 'auth' command"),
+			[]string{"alice secret", "secret"}, true},
+		{url.UserPassword(RedisPlaceholderUser, "secret"),
+			redis.Error("WRONGPASS invalid username-password pair"),
+			[]string{RedisPlaceholderUser + " secret", "secret"}, true},
+		{url.UserPassword("alice", "secret"),
+			redis.Error("WRONGPASS invalid username-password pair"),
+			[]string{"alice secret"}, false},
+	}
+
+	for _, c := range cases {
+		conn := &authConn{aclErr: c.aclErr}
+		err := redisAuth(conn, c.user)
+		if (err == nil) != c.ok {
+			t.Errorf("Expected %v to authenticate %v, got error %v\n", c.user, c.ok, err)
+		}
+		if !reflect.DeepEqual(c.expected, conn.auths) {
+			t.Errorf("Expected AUTH calls %q, got %q\n", c.expected, conn.auths)
+		}
+	}
+}
+
+func TestRedisConnectDatabase(t *testing.T) {
+	conn, err := redisConnect("redis://localhost:6379/2", nil)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Do("SET", "lvat-test-database", "value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Do("DEL", "lvat-test-database")
+
+	other := connPool.Get()
+	defer other.Close()
+
+	exists, _ := redis.Bool(other.Do("EXISTS", "lvat-test-database"))
+	if exists {
+		t.Errorf("Expected key to be stored outside of the default database\n")
+	}
+
+	_, err = redisConnect("redis://localhost:6379/two", nil)()
+	if err == nil {
+		t.Errorf("Expected an error for a bad database\n")
+	}
+}
+
+func TestRedisConnectScheme(t *testing.T) {
+	_, err := redisConnect("http://localhost:6379", nil)()
+	if err == nil {
+		t.Errorf("Expected an error for an unknown scheme\n")
+	}
+}
+
+// Generates a self-signed certificate for localhost along with a pool that
+// trusts it.
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		NotAfter:              time.Now().Add(time.Hour),
+		NotBefore:             time.Now().Add(-time.Hour),
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(parsed)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, roots
+}
+
+// Launches a redis-server for a test on a free port, which replaces any
+// `{port}` in its arguments. Returns the address to connect to. The test is
+// skipped if redis-server isn't installed.
+func testRedisServer(t *testing.T, args ...string) string {
+	path, err := exec.LookPath("redis-server")
+	if err != nil {
+		t.Skip("redis-server isn't installed")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	listener.Close()
+
+	args = append([]string{"--bind", "127.0.0.1", "--save", "", "--appendonly", "no"}, args...)
+	for i, arg := range args {
+		args[i] = strings.Replace(arg, "{port}", port, -1)
+	}
+
+	cmd := exec.Command(path, args...)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	addr := "127.0.0.1:" + port
+	for i := 0; i < 100; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return addr
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Fatalf("Expected redis-server to listen on %v\n", addr)
+	return ""
+}
+
+// authConn is a connection that records the AUTH commands sent to it, and
+// fails the ACL form (with a user) with aclErr.
+type authConn struct {
+	aclErr error
+	auths  []string
+}
+
+func (c *authConn) Close() error                                       { return nil }
+func (c *authConn) Err() error                                         { return nil }
+func (c *authConn) Flush() error                                       { return nil }
+func (c *authConn) Receive() (interface{}, error)                      { return nil, nil }
+func (c *authConn) Send(commandName string, args ...interface{}) error { return nil }
+
+func (c *authConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	auth := make([]string, len(args))
+	for i, arg := range args {
+		auth[i] = arg.(string)
+	}
+	c.auths = append(c.auths, strings.Join(auth, " "))
+
+	if len(args) == 2 && c.aclErr != nil {
+		return nil, c.aclErr
+	}
+	return "OK", nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Defaults for adaptive concurrency. Workers are added while the queue
+	// is deeper than WorkersGrowDepth (as a fraction of its capacity), and
+	// shed while it's empty or while stores take longer than the maximum
+	// latency on average.
+	WorkersDefaultAdjustInterval = 5 * time.Second
+	WorkersDefaultMaxLatency     = 100 * time.Millisecond
+	WorkersGrowDepth             = 0.5
+)
+
+// WorkerOptions configures the Receiver's workers and queue. Concurrency is
+// adaptive when maxWorkers is greater than minWorkers, and fixed at
+// minWorkers otherwise.
+type WorkerOptions struct {
+	maxWorkers int
+	minWorkers int
+	queueSize  int
+
+	// How often the number of workers is adjusted, and the average store
+	// latency past which Redis is considered to be struggling.
+	adjustInterval time.Duration
+	maxLatency     time.Duration
+}
+
+func defaultWorkerOptions() *WorkerOptions {
+	return &WorkerOptions{
+		adjustInterval: WorkersDefaultAdjustInterval,
+		maxLatency:     WorkersDefaultMaxLatency,
+		maxWorkers:     Concurrency,
+		minWorkers:     Concurrency,
+		queueSize:      BufferSize,
+	}
+}
+
+// Reads worker options from the environment. WORKERS fixes the number of
+// workers, while WORKERS_MIN and WORKERS_MAX make it adaptive between the
+// two.
+func parseWorkerOptions() (*WorkerOptions, error) {
+	options := defaultWorkerOptions()
+
+	ints := []struct {
+		name  string
+		value *int
+	}{
+		{"WORKERS", &options.minWorkers},
+		{"WORKERS_MIN", &options.minWorkers},
+		{"WORKERS_MAX", &options.maxWorkers},
+		{"QUEUE_SIZE", &options.queueSize},
+	}
+	for _, i := range ints {
+		if os.Getenv(i.name) == "" {
+			continue
+		}
+
+		var err error
+		*i.value, err = strconv.Atoi(os.Getenv(i.name))
+		if err != nil || *i.value < 1 {
+			return nil, fmt.Errorf("%s must be a positive integer", i.name)
+		}
+	}
+
+	if os.Getenv("WORKERS") != "" {
+		if os.Getenv("WORKERS_MIN") != "" || os.Getenv("WORKERS_MAX") != "" {
+			return nil, fmt.Errorf("WORKERS can't be combined with WORKERS_MIN or WORKERS_MAX")
+		}
+		options.maxWorkers = options.minWorkers
+	} else if os.Getenv("WORKERS_MAX") == "" {
+		options.maxWorkers = options.minWorkers
+	}
+
+	if options.maxWorkers < options.minWorkers {
+		return nil, fmt.Errorf("WORKERS_MAX must be at least WORKERS_MIN")
+	}
+
+	durations := map[string]*time.Duration{
+		"WORKERS_ADJUST_INTERVAL": &options.adjustInterval,
+		"WORKERS_MAX_LATENCY":     &options.maxLatency,
+	}
+	for name, duration := range durations {
+		if os.Getenv(name) == "" {
+			continue
+		}
+
+		var err error
+		*duration, err = time.ParseDuration(os.Getenv(name))
+		if err != nil || *duration <= 0 {
+			return nil, fmt.Errorf("%s must be a duration like `5s`", name)
+		}
+	}
+
+	return options, nil
+}
+
+// ReceiverMetrics describes the Receiver's workers and queue.
+type ReceiverMetrics struct {
+	Conflicts      int64   `json:"conflicts"`
+	MaxWorkers     int     `json:"max_workers"`
+	MinWorkers     int     `json:"min_workers"`
+	QueueCapacity  int     `json:"queue_capacity"`
+	QueueSize      int     `json:"queue_size"`
+	StoreLatencyMs float64 `json:"store_latency_ms"`
+	TargetWorkers  int     `json:"target_workers"`
+	Workers        int     `json:"workers"`
+	Writing        int     `json:"writing"`
+}
+
+func (r *Receiver) Metrics() *ReceiverMetrics {
+	return &ReceiverMetrics{
+		Conflicts:      atomic.LoadInt64(&r.conflicts),
+		MaxWorkers:     r.options.maxWorkers,
+		MinWorkers:     r.options.minWorkers,
+		QueueCapacity:  cap(r.MessagesChan),
+		QueueSize:      len(r.MessagesChan),
+		StoreLatencyMs: float64(atomic.LoadInt64(&r.lastLatency)) / float64(time.Millisecond),
+		TargetWorkers:  r.Target(),
+		Workers:        r.Workers(),
+		Writing:        r.Writing(),
+	}
+}
+
+// Gets the number of workers that should be writing to Redis at once.
+func (r *Receiver) Target() int {
+	return int(atomic.LoadInt32(&r.target))
+}
+
+// Records how long a store to Redis took so that concurrency can be adjusted
+// for it.
+func (r *Receiver) recordLatency(latency time.Duration) {
+	atomic.AddInt64(&r.latencyTotal, int64(latency))
+	atomic.AddInt64(&r.latencyCount, 1)
+}
+
+// Adjusts the number of workers every interval until MessagesChan is
+// closed.
+func (r *Receiver) adapt() {
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-time.After(r.options.adjustInterval):
+		}
+
+		total := atomic.SwapInt64(&r.latencyTotal, 0)
+		count := atomic.SwapInt64(&r.latencyCount, 0)
+
+		var latency time.Duration
+		if count > 0 {
+			latency = time.Duration(total / count)
+		}
+		atomic.StoreInt64(&r.lastLatency, int64(latency))
+
+		r.scale(adjustWorkers(r.Target(), r.queueDepth(), latency, r.options))
+	}
+}
+
+// Gets how full the queue is as a fraction of its capacity. Groups waiting
+// on shards count too, because while they back up the dispatcher blocks and
+// MessagesChan only fills once they're full.
+func (r *Receiver) queueDepth() float64 {
+	size := len(r.MessagesChan)
+	capacity := cap(r.MessagesChan)
+	for _, shard := range r.shards {
+		size += len(shard)
+		capacity += cap(shard)
+	}
+	return float64(size) / float64(capacity)
+}
+
+// Decides how many workers there should be given the current number, the
+// depth of the queue, and the average store latency. Slow stores mean that
+// Redis is struggling, so workers are shed quickly rather than adding to
+// its load. Otherwise workers are added quickly while the queue backs up,
+// and shed one at a time while it's empty.
+func adjustWorkers(current int, depth float64, latency time.Duration,
+	options *WorkerOptions) int {
+
+	step := current / 4
+	if step < 1 {
+		step = 1
+	}
+
+	target := current
+	switch {
+	case latency > options.maxLatency:
+		target = current - step
+	case depth > WorkersGrowDepth:
+		target = current + step
+	case depth == 0:
+		target = current - 1
+	}
+
+	if target < options.minWorkers {
+		target = options.minWorkers
+	}
+	if target > options.maxWorkers {
+		target = options.maxWorkers
+	}
+	return target
+}
+
+// Changes the number of workers allowed to write to Redis at once. Shards
+// already writing finish their current group when it's lowered, and shards
+// waiting for their turn are woken when it's raised.
+func (r *Receiver) scale(target int) {
+	r.writingMutex.Lock()
+	current := r.Target()
+	atomic.StoreInt32(&r.target, int32(target))
+	r.writingCond.Broadcast()
+	r.writingMutex.Unlock()
+
+	if target == current {
+		return
+	}
+
+	printVerbose("scale_workers from=%v to=%v queue=%v\n",
+		current, target, len(r.MessagesChan))
+}
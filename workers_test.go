@@ -0,0 +1,169 @@
+package main
+
+import (
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseWorkerOptions(t *testing.T) {
+	defer os.Unsetenv("WORKERS")
+	defer os.Unsetenv("WORKERS_MIN")
+	defer os.Unsetenv("WORKERS_MAX")
+	defer os.Unsetenv("QUEUE_SIZE")
+
+	os.Setenv("WORKERS", "10")
+	os.Setenv("QUEUE_SIZE", "50")
+
+	options, err := parseWorkerOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.minWorkers != 10 || options.maxWorkers != 10 {
+		t.Errorf("Expected fixed workers %v, got %v-%v\n",
+			10, options.minWorkers, options.maxWorkers)
+	}
+	if options.queueSize != 50 {
+		t.Errorf("Expected queue size %v, got %v\n", 50, options.queueSize)
+	}
+
+	os.Unsetenv("WORKERS")
+	os.Setenv("WORKERS_MIN", "5")
+	os.Setenv("WORKERS_MAX", "80")
+
+	options, err = parseWorkerOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.minWorkers != 5 || options.maxWorkers != 80 {
+		t.Errorf("Expected adaptive workers %v-%v, got %v-%v\n",
+			5, 80, options.minWorkers, options.maxWorkers)
+	}
+
+	os.Setenv("WORKERS_MAX", "4")
+	if _, err := parseWorkerOptions(); err == nil {
+		t.Errorf("Expected an error for a maximum below the minimum\n")
+	}
+}
+
+func TestAdjustWorkers(t *testing.T) {
+	options := defaultWorkerOptions()
+	options.minWorkers = 4
+	options.maxWorkers = 40
+
+	cases := []struct {
+		current  int
+		depth    float64
+		latency  time.Duration
+		expected int
+	}{
+		// backed up: grow by a quarter
+		{20, 0.8, 10 * time.Millisecond, 25},
+		// backed up but at the limit
+		{40, 0.8, 10 * time.Millisecond, 40},
+		// Redis is slow: shrink by a quarter even though the queue is
+		// backed up
+		{20, 0.8, time.Second, 15},
+		// idle: shrink by one
+		{20, 0, 0, 19},
+		// idle but at the limit
+		{4, 0, 0, 4},
+		// keeping up
+		{20, 0.2, 10 * time.Millisecond, 20},
+	}
+	for _, c := range cases {
+		actual := adjustWorkers(c.current, c.depth, c.latency, options)
+		if actual != c.expected {
+			t.Errorf("Expected %v workers from %v (depth=%v latency=%v), got %v\n",
+				c.expected, c.current, c.depth, c.latency, actual)
+		}
+	}
+}
+
+func TestReceiverScale(t *testing.T) {
+	setup(t)
+
+	options := defaultWorkerOptions()
+	options.minWorkers = 2
+	options.maxWorkers = 6
+	options.adjustInterval = time.Hour
+
+	subject := NewReceiverWithOptions([]*IndexConf{conf}, connPool, options)
+	subject.Run()
+	defer close(subject.MessagesChan)
+
+	// a worker runs for every shard no matter how many can write
+	waitForWorkers(t, subject, 6)
+
+	subject.acquireWorker()
+	subject.acquireWorker()
+
+	acquired := make(chan struct{})
+	go func() {
+		subject.acquireWorker()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatalf("Expected a third write to wait with a target of 2\n")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	subject.scale(3)
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected a third write to go ahead with a target of 3\n")
+	}
+
+	metrics := subject.Metrics()
+	if metrics.TargetWorkers != 3 {
+		t.Errorf("Expected target workers %v, got %v\n", 3, metrics.TargetWorkers)
+	}
+	if metrics.Writing != 3 {
+		t.Errorf("Expected %v writing, got %v\n", 3, metrics.Writing)
+	}
+	if metrics.QueueCapacity != options.queueSize {
+		t.Errorf("Expected queue capacity %v, got %v\n", options.queueSize, metrics.QueueCapacity)
+	}
+
+	for i := 0; i < 3; i++ {
+		subject.releaseWorker()
+	}
+}
+
+func TestReceiverQueueDepth(t *testing.T) {
+	options := defaultWorkerOptions()
+	options.minWorkers = 2
+	options.maxWorkers = 4
+	options.queueSize = 10
+
+	subject := NewReceiverWithOptions([]*IndexConf{conf}, connPool, options)
+	atomic.StoreInt32(&subject.target, 2)
+
+	if depth := subject.queueDepth(); depth != 0 {
+		t.Errorf("Expected depth %v, got %v\n", 0, depth)
+	}
+
+	// groups backed up on a shard count even while MessagesChan is empty
+	for i := 0; i < 5; i++ {
+		subject.shards[0] <- &StoreJob{conf: conf, value: "req1"}
+	}
+	subject.MessagesChan <- nil
+
+	expected := float64(6) / float64(options.queueSize+4*ShardBufferSize)
+	if depth := subject.queueDepth(); depth != expected {
+		t.Errorf("Expected depth %v, got %v\n", expected, depth)
+	}
+}
+
+func waitForWorkers(t *testing.T, subject *Receiver, expected int) {
+	for i := 0; i < 100 && subject.Workers() != expected; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if subject.Workers() != expected {
+		t.Fatalf("Expected %v workers, got %v\n", expected, subject.Workers())
+	}
+}